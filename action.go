@@ -0,0 +1,51 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// What to do with requests from banned clients
+const (
+	banActionBlock     = "block"
+	banActionRedirect  = "redirect"
+	banActionTarpit    = "tarpit"
+	banActionDrop      = "drop"
+	banActionChallenge = "challenge"
+	banActionCaptcha   = "captcha"
+)
+
+func parseBanAction(action string) (string, error) {
+	switch a := strings.ToLower(action); a {
+	case "":
+		return banActionBlock, nil
+	case banActionBlock, banActionRedirect, banActionTarpit, banActionDrop, banActionChallenge, banActionCaptcha:
+		return a, nil
+	default:
+		return "", fmt.Errorf("invalid ban action %q", action)
+	}
+}
+
+// Respond to a banned client
+func (f *fail2Ban) writeBanned(rw http.ResponseWriter, req *http.Request, ban *banDetails) {
+	var err error
+	switch f.banAction {
+	case banActionRedirect:
+		err = f.redirect.write(rw, *ban)
+	case banActionTarpit:
+		err = f.writeTarpit(rw, req, *ban)
+	case banActionDrop:
+		err = f.writeDrop(rw, req, *ban)
+	case banActionChallenge, banActionCaptcha:
+		if err = f.challenger.writeChallenge(rw, req, *ban); err != nil {
+			f.logger.Warnf("Failed to challenge %s, sending ban response: %s", ban.IP, err)
+			err = f.banResponse.write(rw, req, *ban)
+		}
+	default:
+		err = f.banResponse.write(rw, req, *ban)
+	}
+	if err != nil {
+		f.logger.Errorf("Failed to write ban response for %s: %s", ban.IP, err)
+	}
+}
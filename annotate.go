@@ -0,0 +1,83 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnnotateConfig passes what the middleware knows about a client downstream
+// as request headers, so applications can make their own decisions
+type AnnotateConfig struct {
+	Enabled bool
+	// HeaderPrefix of the added headers, defaults to "X-Fail2ban-"
+	HeaderPrefix string
+	// WarnAfter this many failures the client is in the warning state, defaults to 1
+	WarnAfter uint
+}
+
+type annotate struct {
+	fails     string
+	maxFails  string
+	warning   string
+	rules     string
+	warnAfter uint
+}
+
+func newAnnotate(config AnnotateConfig) (*annotate, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	prefix := config.HeaderPrefix
+	if len(prefix) == 0 {
+		prefix = "X-Fail2ban-"
+	}
+	if strings.ContainsAny(prefix, " \t\r\n:") {
+		return nil, fmt.Errorf("invalid annotate header prefix %q", prefix)
+	}
+	a := &annotate{
+		fails:     http.CanonicalHeaderKey(prefix + "Fails"),
+		maxFails:  http.CanonicalHeaderKey(prefix + "Max-Fails"),
+		warning:   http.CanonicalHeaderKey(prefix + "Warning"),
+		rules:     http.CanonicalHeaderKey(prefix + "Rules"),
+		warnAfter: config.WarnAfter,
+	}
+	if a.warnAfter == 0 {
+		a.warnAfter = 1
+	}
+	return a, nil
+}
+
+// Remove copies of the headers sent by the client, so they can't be spoofed
+func (a *annotate) strip(req *http.Request) {
+	for _, h := range []string{a.fails, a.maxFails, a.warning, a.rules} {
+		req.Header.Del(h)
+	}
+}
+
+// Add the client's fail count, warning state and the rules it matched to the request
+func (f *fail2Ban) annotateRequest(ip string, req *http.Request) {
+	if f.annotate == nil {
+		return
+	}
+	var failCounter uint
+	var rules []string
+	maxFails := f.maxFails
+	throttled := false
+	if c, ok := f.store.Get(ip); ok {
+		failCounter = c.failCounter
+		maxFails = c.threshold(f.maxFails)
+		rules = c.matched
+		throttled = c.throttledUntil.After(time.Now())
+	}
+
+	warning := failCounter >= f.annotate.warnAfter || len(rules) != 0 || throttled
+	req.Header.Set(f.annotate.fails, strconv.FormatUint(uint64(failCounter), 10))
+	req.Header.Set(f.annotate.maxFails, strconv.FormatUint(uint64(maxFails), 10))
+	req.Header.Set(f.annotate.warning, strconv.FormatBool(warning))
+	if len(rules) != 0 {
+		req.Header.Set(f.annotate.rules, strings.Join(rules, ","))
+	}
+}
@@ -0,0 +1,84 @@
+package fail2ban
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnnotate(t *testing.T) {
+	var seen http.Header
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 3,
+			Mode:        "monitor",
+			Annotate:    AnnotateConfig{Enabled: true, WarnAfter: 2},
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Header.Clone()
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+
+	serve := func(path string) {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://garbage"+path, nil)
+		request.RemoteAddr = "1.2.3.4:5678"
+		// spoofed copies must never reach the application
+		request.Header.Set("X-Fail2ban-Warning", "false")
+		request.Header.Set("X-Fail2ban-Rules", "spoofed")
+		f.ServeHTTP(response, request)
+	}
+
+	tests := []struct {
+		path    string
+		fails   string
+		warning string
+		rules   string
+	}{
+		{"/", "0", "false", ""},
+		{"/missing", "0", "false", ""},
+		{"/missing", "1", "false", ""},
+		{"/missing", "2", "true", ""},
+		// third failure would have banned the client and started it over
+		{"/", "0", "true", "fails"},
+	}
+	for idx, test := range tests {
+		serve(test.path)
+		if seen.Get("X-Fail2ban-Fails") != test.fails || seen.Get("X-Fail2ban-Warning") != test.warning || seen.Get("X-Fail2ban-Rules") != test.rules {
+			t.Errorf("Request %d: expected fails %q, warning %q and rules %q, got %v", idx, test.fails, test.warning, test.rules, seen)
+		}
+		if seen.Get("X-Fail2ban-Max-Fails") != "3" {
+			t.Errorf("Request %d: expected max fails 3, got %q", idx, seen.Get("X-Fail2ban-Max-Fails"))
+		}
+	}
+}
+
+func TestAnnotateConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  AnnotateConfig
+		prefix  string
+		isError bool
+	}{
+		"disabled":   {AnnotateConfig{HeaderPrefix: "garbage: "}, "", false},
+		"default":    {AnnotateConfig{Enabled: true}, "X-Fail2ban-Fails", false},
+		"prefix":     {AnnotateConfig{Enabled: true, HeaderPrefix: "x-waf-"}, "X-Waf-Fails", false},
+		"bad prefix": {AnnotateConfig{Enabled: true, HeaderPrefix: "X Waf:"}, "", true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, err := newAnnotate(test.config)
+			if (err != nil) != test.isError {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if a != nil && a.fails != test.prefix {
+				t.Errorf("Expected header %q but got %q", test.prefix, a.fails)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package fail2ban
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	bandwidthActionThrottle = "throttle"
+	bandwidthActionBan      = "ban"
+)
+
+// BandwidthConfig limits how many response bytes a client can pull per window
+type BandwidthConfig struct {
+	// MaxBytes per client per window, 0 disables the quota
+	MaxBytes uint64
+	Window   string
+	// Action is either "throttle" or "ban"
+	Action             string
+	ExemptPaths        []string
+	ExemptContentTypes []string
+	// Mode is "enforce" or "monitor", defaults to the top level Mode
+	Mode string
+}
+
+type bandwidth struct {
+	maxBytes           uint64
+	window             time.Duration
+	ban                bool
+	exemptPaths        []string
+	exemptContentTypes []string
+}
+
+func newBandwidth(config BandwidthConfig) (*bandwidth, error) {
+	if config.MaxBytes == 0 {
+		return nil, nil
+	}
+	window := time.Hour
+	if len(config.Window) != 0 {
+		d, err := time.ParseDuration(config.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth window: %w", err)
+		}
+		window = d
+	}
+	b := &bandwidth{
+		maxBytes:    config.MaxBytes,
+		window:      window,
+		exemptPaths: config.ExemptPaths,
+	}
+	switch strings.ToLower(config.Action) {
+	case "", bandwidthActionThrottle:
+	case bandwidthActionBan:
+		b.ban = true
+	default:
+		return nil, fmt.Errorf("invalid bandwidth action %q", config.Action)
+	}
+	for _, ct := range config.ExemptContentTypes {
+		b.exemptContentTypes = append(b.exemptContentTypes, strings.ToLower(ct))
+	}
+	return b, nil
+}
+
+// Check if the request or its response should not count towards the quota
+func (b *bandwidth) isExempt(req *http.Request, header http.Header) bool {
+	for _, p := range b.exemptPaths {
+		if strings.HasPrefix(req.URL.Path, p) {
+			return true
+		}
+	}
+	if len(b.exemptContentTypes) == 0 {
+		return false
+	}
+	ct, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, exempt := range b.exemptContentTypes {
+		// allow wildcards like "image/*"
+		if exempt == ct || (strings.HasSuffix(exempt, "/*") && strings.HasPrefix(ct, exempt[:len(exempt)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// response bytes sent to a client
+type byteWindow struct {
+	start time.Time
+	bytes uint64
+	total uint64
+}
+
+// Add bytes to the current window, starting a new one if it has elapsed
+func (w *byteWindow) add(now time.Time, n uint64, window time.Duration) uint64 {
+	if now.After(w.start.Add(window)) {
+		w.start = now
+		w.bytes = 0
+	}
+	w.bytes += n
+	w.total += n
+	return w.bytes
+}
+
+// Time until the current window resets
+func (w byteWindow) remaining(now time.Time, window time.Duration) time.Duration {
+	return w.start.Add(window).Sub(now)
+}
@@ -0,0 +1,158 @@
+package fail2ban
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newBandwidthTestServer(t *testing.T, bw BandwidthConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 3,
+			Bandwidth:   bw,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/image" {
+				w.Header().Set("Content-Type", "image/png")
+			}
+			w.Write(make([]byte, 100))
+		}),
+	)
+	return f
+}
+
+func serveBandwidthRequest(f *fail2Ban, path string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://garbage"+path, nil)
+	request.RemoteAddr = "1.2.3.4:5678"
+	f.ServeHTTP(response, request)
+	return response
+}
+
+func TestBandwidthThrottle(t *testing.T) {
+	f := newBandwidthTestServer(t, BandwidthConfig{
+		MaxBytes: 250,
+		Window:   "1m",
+		Action:   "throttle",
+	})
+
+	for idx := 0; idx < 3; idx++ {
+		if response := serveBandwidthRequest(f, "/"); response.Code != http.StatusOK {
+			t.Errorf("Expected request %d to be %d but got %d", idx, http.StatusOK, response.Code)
+		}
+	}
+	response := serveBandwidthRequest(f, "/")
+	if response.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected response to be %d but got %d", http.StatusTooManyRequests, response.Code)
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+
+	info, ok := f.inspectClient("1.2.3.4")
+	if !ok {
+		t.FailNow()
+	}
+	if info.Banned {
+		t.Error("Client should only be throttled")
+	}
+	if info.BytesInWindow != 300 || info.BytesTotal != 300 {
+		t.Errorf("Expected 300 bytes to be counted, got %d in window and %d total", info.BytesInWindow, info.BytesTotal)
+	}
+
+	stats := f.snapshotStats()
+	if stats.Bytes != 300 {
+		t.Errorf("Expected 300 bytes in stats, got %d", stats.Bytes)
+	}
+	if stats.Events[eventThrottle] != 1 {
+		t.Errorf("Expected 1 throttle event, got %d", stats.Events[eventThrottle])
+	}
+}
+
+func TestBandwidthBan(t *testing.T) {
+	f := newBandwidthTestServer(t, BandwidthConfig{
+		MaxBytes: 150,
+		Action:   "ban",
+	})
+
+	serveBandwidthRequest(f, "/")
+	serveBandwidthRequest(f, "/")
+	if response := serveBandwidthRequest(f, "/"); response.Code != http.StatusForbidden {
+		t.Errorf("Expected response to be %d but got %d", http.StatusForbidden, response.Code)
+	}
+	info, _ := f.inspectClient("1.2.3.4")
+	if !info.Banned || info.BanRule != ruleBandwidth {
+		t.Errorf("Client should be banned by %q, got %+v", ruleBandwidth, info)
+	}
+}
+
+func TestBandwidthExemptions(t *testing.T) {
+	f := newBandwidthTestServer(t, BandwidthConfig{
+		MaxBytes:           50,
+		Action:             "ban",
+		ExemptPaths:        []string{"/static/"},
+		ExemptContentTypes: []string{"image/*"},
+	})
+
+	for idx := 0; idx < 5; idx++ {
+		if response := serveBandwidthRequest(f, "/static/app.js"); response.Code != http.StatusOK {
+			t.Errorf("Exempt path should not be limited, got %d", response.Code)
+		}
+		if response := serveBandwidthRequest(f, "/image"); response.Code != http.StatusOK {
+			t.Errorf("Exempt content type should not be limited, got %d", response.Code)
+		}
+	}
+	if _, ok := f.inspectClient("1.2.3.4"); ok {
+		t.Error("Exempt responses should not track the client")
+	}
+	if stats := f.snapshotStats(); stats.Bytes != 1000 {
+		t.Errorf("Exempt bytes should still show in stats, got %d", stats.Bytes)
+	}
+}
+
+func TestBandwidthConfig(t *testing.T) {
+	tests := map[string]struct {
+		config   BandwidthConfig
+		disabled bool
+		isError  bool
+	}{
+		"disabled":        {BandwidthConfig{Window: "1h"}, true, false},
+		"defaults":        {BandwidthConfig{MaxBytes: 1}, false, false},
+		"bad window":      {BandwidthConfig{MaxBytes: 1, Window: "garbage"}, false, true},
+		"bad action":      {BandwidthConfig{MaxBytes: 1, Action: "garbage"}, false, true},
+		"any case action": {BandwidthConfig{MaxBytes: 1, Action: "BAN"}, false, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := newBandwidth(test.config)
+			if (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+			if !test.isError && (b == nil) != test.disabled {
+				t.Errorf("Expected disabled to be %t", test.disabled)
+			}
+		})
+	}
+}
+
+func TestByteWindow(t *testing.T) {
+	now := time.Now()
+	w := byteWindow{}
+	if w.add(now, 10, time.Minute) != 10 {
+		t.Error("Should count bytes in new window")
+	}
+	if w.add(now.Add(time.Second), 10, time.Minute) != 20 {
+		t.Error("Should accumulate bytes in window")
+	}
+	if w.add(now.Add(2*time.Minute), 5, time.Minute) != 5 {
+		t.Error("Should start a new window")
+	}
+	if w.total != 25 {
+		t.Errorf("Total should be 25, got %d", w.total)
+	}
+}
@@ -0,0 +1,238 @@
+package fail2ban
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CaptchaConfig sends banned clients a CAPTCHA to solve, verified against a
+// Cloudflare Turnstile or hCaptcha compatible siteverify endpoint
+type CaptchaConfig struct {
+	// Provider is either "turnstile" or "hcaptcha", and sets defaults for the settings below
+	Provider      string
+	SiteKey       string
+	Secret        string
+	VerifyURL     string
+	ScriptURL     string
+	WidgetClass   string
+	ResponseField string
+	// Path solved CAPTCHAs get sent to
+	Path    string
+	Timeout string
+	// PassSecret used to sign pass cookies, a random one is used if not set
+	PassSecret string
+	CookieName string
+	CookieTTL  string
+}
+
+// defaults for each provider
+var captchaProviders = map[string]CaptchaConfig{
+	"turnstile": {
+		VerifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		ScriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		WidgetClass:   "cf-turnstile",
+		ResponseField: "cf-turnstile-response",
+	},
+	"hcaptcha": {
+		VerifyURL:     "https://api.hcaptcha.com/siteverify",
+		ScriptURL:     "https://js.hcaptcha.com/1/api.js",
+		WidgetClass:   "h-captcha",
+		ResponseField: "h-captcha-response",
+	},
+}
+
+type captcha struct {
+	siteKey       string
+	secret        string
+	verifyURL     string
+	scriptURL     string
+	widgetClass   string
+	responseField string
+	path          string
+	client        *http.Client
+	passes        *passIssuer
+	stats         *stats
+	// reference of the client's ban once it has been sent a CAPTCHA, empty
+	// when it hasn't
+	banRef func(ip string) string
+	// called once a client solves the CAPTCHA for a ban
+	onPass func(ip string, ref string)
+	// called for CAPTCHAs the provider rejected
+	onFail func(ip string)
+}
+
+func newCaptcha(config CaptchaConfig, s *stats, banRef func(ip string) string, onPass func(ip string, ref string), onFail func(ip string)) (*captcha, error) {
+	provider := strings.ToLower(config.Provider)
+	if len(provider) == 0 {
+		provider = "turnstile"
+	}
+	defaults, ok := captchaProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf("invalid captcha provider %q", config.Provider)
+	}
+	if len(config.SiteKey) == 0 || len(config.Secret) == 0 {
+		return nil, fmt.Errorf("captcha site key and secret must be set")
+	}
+	c := &captcha{
+		siteKey:       config.SiteKey,
+		secret:        config.Secret,
+		verifyURL:     pick(config.VerifyURL, defaults.VerifyURL),
+		scriptURL:     pick(config.ScriptURL, defaults.ScriptURL),
+		widgetClass:   pick(config.WidgetClass, defaults.WidgetClass),
+		responseField: pick(config.ResponseField, defaults.ResponseField),
+		path:          pick(config.Path, "/.fail2ban/captcha"),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		stats:         s,
+		banRef:        banRef,
+		onPass:        onPass,
+		onFail:        onFail,
+	}
+	if _, err := url.ParseRequestURI(c.verifyURL); err != nil {
+		return nil, fmt.Errorf("invalid captcha verify URL: %w", err)
+	}
+	if !strings.HasPrefix(c.path, "/") {
+		return nil, fmt.Errorf("captcha path %q must start with /", c.path)
+	}
+	if len(config.Timeout) != 0 {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid captcha timeout: %w", err)
+		}
+		c.client.Timeout = d
+	}
+	var err error
+	if c.passes, err = newPassIssuer(config.PassSecret, config.CookieName, config.CookieTTL); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func pick(value string, fallback string) string {
+	if len(value) != 0 {
+		return value
+	}
+	return fallback
+}
+
+// Ask the siteverify endpoint if the token the client sent is valid
+func (c *captcha) verify(req *http.Request, token string, ip string) (bool, error) {
+	if len(token) == 0 {
+		return false, nil
+	}
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {token},
+		"remoteip": {ip},
+	}
+	verifyReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	verifyReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(verifyReq)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verify endpoint responded with %d", resp.StatusCode)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("invalid captcha verify response: %w", err)
+	}
+	if !result.Success && len(result.ErrorCodes) != 0 {
+		return false, fmt.Errorf("captcha verify failed with %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return result.Success, nil
+}
+
+func (c *captcha) serveChallenge(rw http.ResponseWriter, req *http.Request, ip string) bool {
+	if req.URL.Path != c.path {
+		return false
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return true
+	}
+	// only ask the provider about clients which were sent a CAPTCHA, so
+	// anyone else can't use up its quota
+	ref := c.banRef(ip)
+	if len(ref) == 0 {
+		rw.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	ok, err := c.verify(req, req.PostFormValue(c.responseField), ip)
+	if err != nil {
+		// let the client try again rather than treating errors as a failed CAPTCHA
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+	if !ok {
+		c.onFail(ip)
+		rw.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	c.stats.record(eventChallengePassed)
+	c.onPass(ip, ref)
+	c.passes.issue(rw, req, ip, ref)
+	http.Redirect(rw, req, returnPath(req.PostFormValue("return")), http.StatusSeeOther)
+	return true
+}
+
+func (c *captcha) hasPass(req *http.Request, ip string, ref string) bool {
+	return c.passes.valid(req, ip, ref)
+}
+
+var captchaPage = htmltemplate.Must(htmltemplate.New("captcha").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Checking you are human</title>
+<script src="{{.ScriptURL}}" async defer></script>
+</head>
+<body>
+<p>Too many bad requests have been made from {{.IP}}, please complete the check below to continue.</p>
+<form id="captcha" method="POST" action="{{.Path}}">
+<input type="hidden" name="return" value="{{.Return}}">
+<div class="{{.WidgetClass}}" data-sitekey="{{.SiteKey}}" data-callback="captchaSolved"></div>
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+<script>
+function captchaSolved() {
+  document.getElementById("captcha").submit();
+}
+</script>
+</body>
+</html>
+`))
+
+func (c *captcha) writeChallenge(rw http.ResponseWriter, req *http.Request, ban banDetails) error {
+	var buff bytes.Buffer
+	err := captchaPage.Execute(&buff, struct {
+		IP          string
+		Path        string
+		Return      string
+		ScriptURL   string
+		WidgetClass string
+		SiteKey     string
+	}{ban.IP, c.path, req.URL.RequestURI(), c.scriptURL, c.widgetClass, c.siteKey})
+	if err != nil {
+		return err
+	}
+	c.stats.record(eventChallenge)
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusForbidden)
+	_, err = rw.Write(buff.Bytes())
+	return err
+}
@@ -0,0 +1,153 @@
+package fail2ban
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stub siteverify endpoint accepting the token "pass" from 1.2.3.4, counting
+// the requests it gets
+func newSiteVerifyStub(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if r.PostFormValue("secret") != "captcha-secret" {
+			json.NewEncoder(w).Encode(map[string]any{"success": false, "error-codes": []string{"invalid-input-secret"}})
+			return
+		}
+		switch r.PostFormValue("response") {
+		case "pass":
+			json.NewEncoder(w).Encode(map[string]any{"success": r.PostFormValue("remoteip") == "1.2.3.4"})
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"success": false})
+		}
+	}))
+}
+
+func newCaptchaTestServer(t *testing.T, config CaptchaConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:      "1h",
+			LogLevel:     "ERROR",
+			NumberFails:  2,
+			ClientHeader: "client",
+			BanAction:    "captcha",
+			Captcha:      config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 5, banRule: ruleScanner}
+	return f
+}
+
+func TestCaptchaPassed(t *testing.T) {
+	var calls int32
+	stub := newSiteVerifyStub(t, &calls)
+	defer stub.Close()
+	f := newCaptchaTestServer(t, CaptchaConfig{
+		Provider:  "hcaptcha",
+		SiteKey:   "site-key",
+		Secret:    "captcha-secret",
+		VerifyURL: stub.URL,
+	})
+
+	response := serveChallengeRequest(f, "GET", "http://garbage/page", "1.2.3.4", nil)
+	body := response.Body.String()
+	if response.Code != http.StatusForbidden || !strings.Contains(body, `class="h-captcha" data-sitekey="site-key"`) || !strings.Contains(body, "https://js.hcaptcha.com/1/api.js") {
+		t.Fatalf("Expected CAPTCHA page, got %d %q", response.Code, body)
+	}
+
+	tests := map[string]struct {
+		token  string
+		client string
+		code   int
+		calls  int32
+		fails  uint
+	}{
+		"wrong token":  {"garbage", "1.2.3.4", http.StatusForbidden, 1, 1},
+		"no token":     {"", "1.2.3.4", http.StatusForbidden, 0, 1},
+		"other client": {"pass", "5.6.7.8", http.StatusForbidden, 0, 0},
+		"verify error": {"broken", "1.2.3.4", http.StatusServiceUnavailable, 1, 0},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			before, _ := f.inspectClient(test.client)
+			atomic.StoreInt32(&calls, 0)
+			form := url.Values{"h-captcha-response": {test.token}}
+			if response := serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/captcha", test.client, form); response.Code != test.code {
+				t.Errorf("Expected %d, got %d", test.code, response.Code)
+			}
+			if n := atomic.LoadInt32(&calls); n != test.calls {
+				t.Errorf("Expected %d calls to the provider, got %d", test.calls, n)
+			}
+			if after, _ := f.inspectClient(test.client); after.FailCounter-before.FailCounter != test.fails {
+				t.Errorf("Expected %d more failures, got %d", test.fails, after.FailCounter-before.FailCounter)
+			}
+		})
+	}
+
+	form := url.Values{"h-captcha-response": {"pass"}, "return": {"/page"}}
+	response = serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/captcha", "1.2.3.4", form)
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/page" {
+		t.Fatalf("Expected redirect back, got %d %q", response.Code, response.Header().Get("Location"))
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); info.Banned || info.FailCounter != 0 {
+		t.Errorf("Client should be reset after passing, got %+v", info)
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected pass cookie, got %v", cookies)
+	}
+	if response := serveChallengeRequest(f, "GET", "http://garbage/page", "1.2.3.4", nil, cookies[0]); response.Code != http.StatusOK {
+		t.Errorf("Client with pass should get through, got %d", response.Code)
+	}
+}
+
+func TestCaptchaWrongSecret(t *testing.T) {
+	var calls int32
+	stub := newSiteVerifyStub(t, &calls)
+	defer stub.Close()
+	f := newCaptchaTestServer(t, CaptchaConfig{
+		SiteKey:   "site-key",
+		Secret:    "wrong",
+		VerifyURL: stub.URL,
+	})
+	serveChallengeRequest(f, "GET", "http://garbage/page", "1.2.3.4", nil)
+	form := url.Values{"cf-turnstile-response": {"pass"}}
+	if response := serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/captcha", "1.2.3.4", form); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Verify errors should not count as passing, got %d", response.Code)
+	}
+}
+
+func TestCaptchaConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  CaptchaConfig
+		isError bool
+	}{
+		"turnstile":      {CaptchaConfig{SiteKey: "k", Secret: "s"}, false},
+		"hcaptcha":       {CaptchaConfig{Provider: "hCaptcha", SiteKey: "k", Secret: "s"}, false},
+		"bad provider":   {CaptchaConfig{Provider: "garbage", SiteKey: "k", Secret: "s"}, true},
+		"no site key":    {CaptchaConfig{Secret: "s"}, true},
+		"no secret":      {CaptchaConfig{SiteKey: "k"}, true},
+		"bad verify url": {CaptchaConfig{SiteKey: "k", Secret: "s", VerifyURL: "garbage"}, true},
+		"relative path":  {CaptchaConfig{SiteKey: "k", Secret: "s", Path: "captcha"}, true},
+		"bad timeout":    {CaptchaConfig{SiteKey: "k", Secret: "s", Timeout: "garbage"}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newCaptcha(test.config, newStats(), nil, nil, nil); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
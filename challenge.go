@@ -0,0 +1,383 @@
+package fail2ban
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of unsolved challenges kept around
+	maxPendingChallenges = 10000
+	// maximum number of unsolved challenges kept for one client, the oldest
+	// is replaced past it
+	maxClientChallenges = 5
+)
+
+// Ban actions letting clients prove they aren't a bot to get through
+type challenger interface {
+	// Handle requests for the challenge's own endpoints, false for any other request
+	serveChallenge(rw http.ResponseWriter, req *http.Request, ip string) bool
+	// Check if the client has a valid pass from solving the challenge for the
+	// ban with reference ref
+	hasPass(req *http.Request, ip string, ref string) bool
+	// Send a challenge to a banned client
+	writeChallenge(rw http.ResponseWriter, req *http.Request, ban banDetails) error
+}
+
+// ChallengeConfig sends banned clients a proof of work challenge to solve
+type ChallengeConfig struct {
+	// Difficulty is the number of leading zero bits a solution's hash needs.
+	// The default of 16 takes a browser well under a second, it stops clients
+	// which don't run JavaScript rather than a determined bot.
+	Difficulty uint
+	// Path solutions get sent to
+	Path string
+	// Secret used to sign pass cookies, a random one is used if not set
+	Secret string
+	// Expiry is how long a challenge can be solved in
+	Expiry     string
+	CookieName string
+	CookieTTL  string
+}
+
+// Signed cookies letting clients through after they pass a challenge
+type passIssuer struct {
+	signer     *signer
+	cookieName string
+	ttl        time.Duration
+}
+
+type pass struct {
+	IP string `json:"ip"`
+	// reference of the ban the challenge was solved for
+	Ref     string `json:"ref"`
+	Expires int64  `json:"exp"`
+}
+
+func newPassIssuer(secret string, cookieName string, ttl string) (*passIssuer, error) {
+	p := &passIssuer{cookieName: "fail2ban_pass", ttl: time.Hour}
+	if len(cookieName) != 0 {
+		p.cookieName = cookieName
+	}
+	if len(ttl) != 0 {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pass cookie TTL: %w", err)
+		}
+		p.ttl = d
+	}
+	var err error
+	if p.signer, err = newSigner(secret); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Set a pass cookie bound to the client's IP and the ban it got past
+func (p *passIssuer) issue(rw http.ResponseWriter, req *http.Request, ip string, ref string) {
+	expires := time.Now().Add(p.ttl)
+	payload, _ := json.Marshal(pass{IP: ip, Ref: ref, Expires: expires.Unix()})
+	http.SetCookie(rw, &http.Cookie{
+		Name:     p.cookieName,
+		Value:    p.signer.sign(payload),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(p.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (p *passIssuer) valid(req *http.Request, ip string, ref string) bool {
+	cookie, err := req.Cookie(p.cookieName)
+	if err != nil {
+		return false
+	}
+	payload, ok := p.signer.verify(cookie.Value)
+	if !ok {
+		return false
+	}
+	var v pass
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return false
+	}
+	return v.IP == ip && v.Ref == ref && time.Now().Before(time.Unix(v.Expires, 0))
+}
+
+// Only allow redirecting back to paths on the same site after passing a challenge
+func returnPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+type pendingChallenge struct {
+	ip string
+	// reference of the ban the challenge was handed out for
+	ref     string
+	expires time.Time
+}
+
+type proofOfWork struct {
+	difficulty uint
+	path       string
+	expiry     time.Duration
+	passes     *passIssuer
+	stats      *stats
+	// called once a client solves the challenge for a ban
+	onPass func(ip string, ref string)
+	// called for wrong or unknown solutions
+	onFail func(ip string)
+
+	// challenges handed out which haven't been solved yet, and their IDs
+	// for each client in the order they were handed out
+	mu       sync.Mutex
+	pending  map[string]pendingChallenge
+	byClient map[string][]string
+}
+
+func newProofOfWork(config ChallengeConfig, s *stats, onPass func(ip string, ref string), onFail func(ip string)) (*proofOfWork, error) {
+	p := &proofOfWork{
+		difficulty: 16,
+		path:       "/.fail2ban/challenge",
+		expiry:     5 * time.Minute,
+		stats:      s,
+		onPass:     onPass,
+		onFail:     onFail,
+		pending:    make(map[string]pendingChallenge),
+		byClient:   make(map[string][]string),
+	}
+	if config.Difficulty != 0 {
+		if config.Difficulty > 32 {
+			return nil, fmt.Errorf("challenge difficulty %d is too high, maximum is 32", config.Difficulty)
+		}
+		p.difficulty = config.Difficulty
+	}
+	if len(config.Path) != 0 {
+		if !strings.HasPrefix(config.Path, "/") {
+			return nil, fmt.Errorf("challenge path %q must start with /", config.Path)
+		}
+		p.path = config.Path
+	}
+	if len(config.Expiry) != 0 {
+		d, err := time.ParseDuration(config.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid challenge expiry: %w", err)
+		}
+		p.expiry = d
+	}
+	var err error
+	if p.passes, err = newPassIssuer(config.Secret, config.CookieName, config.CookieTTL); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Hand out a new challenge for the client's ban, false when too many are pending
+func (p *proofOfWork) newChallenge(ip string, ref string) (string, bool) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false
+	}
+	id := hex.EncodeToString(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ids := p.byClient[ip]; len(ids) >= maxClientChallenges {
+		p.forget(ids[0])
+	}
+	if len(p.pending) >= maxPendingChallenges {
+		now := time.Now()
+		for k, c := range p.pending {
+			if now.After(c.expires) {
+				p.forget(k)
+			}
+		}
+		if len(p.pending) >= maxPendingChallenges {
+			return "", false
+		}
+	}
+	p.pending[id] = pendingChallenge{ip: ip, ref: ref, expires: time.Now().Add(p.expiry)}
+	p.byClient[ip] = append(p.byClient[ip], id)
+	return id, true
+}
+
+// Drop a pending challenge, the lock must be held
+func (p *proofOfWork) forget(id string) {
+	c, ok := p.pending[id]
+	if !ok {
+		return
+	}
+	delete(p.pending, id)
+	ids := p.byClient[c.ip]
+	for idx, other := range ids {
+		if other == id {
+			ids = append(ids[:idx], ids[idx+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(p.byClient, c.ip)
+	} else {
+		p.byClient[c.ip] = ids
+	}
+}
+
+// Check the nonce solves the challenge, returning the reference of the ban it
+// was handed out for. Challenges can only be solved once.
+func (p *proofOfWork) solve(ip string, challenge string, nonce string) (string, bool) {
+	p.mu.Lock()
+	pending, ok := p.pending[challenge]
+	if ok && pending.ip == ip {
+		p.forget(challenge)
+	}
+	p.mu.Unlock()
+	if !ok || pending.ip != ip || time.Now().After(pending.expires) {
+		return "", false
+	}
+	return pending.ref, leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) >= p.difficulty
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) uint {
+	var n uint
+	for _, b := range hash {
+		if b != 0 {
+			return n + uint(bits.LeadingZeros8(b))
+		}
+		n += 8
+	}
+	return n
+}
+
+func (p *proofOfWork) serveChallenge(rw http.ResponseWriter, req *http.Request, ip string) bool {
+	if req.URL.Path != p.path {
+		return false
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return true
+	}
+	ref, ok := p.solve(ip, req.PostFormValue("challenge"), req.PostFormValue("nonce"))
+	if !ok {
+		p.onFail(ip)
+		rw.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	p.stats.record(eventChallengePassed)
+	p.onPass(ip, ref)
+	p.passes.issue(rw, req, ip, ref)
+	http.Redirect(rw, req, returnPath(req.PostFormValue("return")), http.StatusSeeOther)
+	return true
+}
+
+func (p *proofOfWork) hasPass(req *http.Request, ip string, ref string) bool {
+	return p.passes.valid(req, ip, ref)
+}
+
+var proofOfWorkPage = htmltemplate.Must(htmltemplate.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Checking your browser</title></head>
+<body>
+<p>Checking your browser, this should only take a few seconds.</p>
+<noscript><p>JavaScript is needed to continue.</p></noscript>
+<form id="challenge" method="POST" action="{{.Path}}">
+<input type="hidden" name="challenge" value="{{.Challenge}}">
+<input type="hidden" name="nonce" value="">
+<input type="hidden" name="return" value="{{.Return}}">
+</form>
+<script>
+(async function () {
+  const challenge = {{.Challenge}}, difficulty = {{.Difficulty}};
+  const encoder = new TextEncoder();
+  const zeroBits = function (hash) {
+    let n = 0;
+    for (const b of hash) {
+      if (b === 0) { n += 8; continue; }
+      return n + Math.clz32(b) - 24;
+    }
+    return n;
+  };
+  for (let nonce = 0; ; nonce++) {
+    const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce)));
+    if (zeroBits(hash) >= difficulty) {
+      const form = document.getElementById("challenge");
+      form.nonce.value = nonce;
+      form.submit();
+      return;
+    }
+  }
+})();
+</script>
+</body>
+</html>
+`))
+
+func (p *proofOfWork) writeChallenge(rw http.ResponseWriter, req *http.Request, ban banDetails) error {
+	challenge, ok := p.newChallenge(ban.IP, ban.Reference)
+	if !ok {
+		return fmt.Errorf("too many pending challenges")
+	}
+	var buff bytes.Buffer
+	err := proofOfWorkPage.Execute(&buff, struct {
+		Path       string
+		Challenge  string
+		Difficulty uint
+		Return     string
+	}{p.path, challenge, p.difficulty, req.URL.RequestURI()})
+	if err != nil {
+		return err
+	}
+	p.stats.record(eventChallenge)
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusForbidden)
+	_, err = rw.Write(buff.Bytes())
+	return err
+}
+
+// Lift the ban with reference ref once the client solved its challenge, a
+// ban the client got since then is kept
+func (f *fail2Ban) clearBan(ip string, ref string) {
+	f.store.Update(ip, false, func(c *client) bool {
+		if c.banRef != ref {
+			return true
+		}
+		f.logger.Infof("Lifted ban %q of %s after passing a challenge", ref, ip)
+		c.failCounter = 0
+		c.banRule = ""
+		c.banRef = ""
+		c.matched = nil
+		return true
+	})
+}
+
+// Reference of the client's ban, empty until a banned request was blocked
+func (f *fail2Ban) currentBanRef(ip string) string {
+	c, ok := f.store.Get(ip)
+	if !ok {
+		return ""
+	}
+	return c.banRef
+}
+
+// Check if the client passed the challenge for the ban it currently has
+func (f *fail2Ban) hasPass(req *http.Request, ip string) bool {
+	if f.challenger == nil {
+		return false
+	}
+	ref := f.currentBanRef(ip)
+	return len(ref) != 0 && f.challenger.hasPass(req, ip, ref)
+}
@@ -0,0 +1,239 @@
+package fail2ban
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newChallengeTestServer(t *testing.T) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:      "1h",
+			LogLevel:     "ERROR",
+			NumberFails:  2,
+			ClientHeader: "client",
+			BanAction:    "challenge",
+			Challenge: ChallengeConfig{
+				Difficulty: 8,
+				Secret:     "secret",
+			},
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 2}
+	return f
+}
+
+func solveChallenge(challenge string, difficulty uint) string {
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+n))) >= difficulty {
+			return n
+		}
+	}
+}
+
+func serveChallengeRequest(f *fail2Ban, method string, target string, client string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	request.Header.Set("client", client)
+	for _, c := range cookies {
+		request.AddCookie(c)
+	}
+	f.ServeHTTP(response, request)
+	return response
+}
+
+var challengeInPage = regexp.MustCompile(`name="challenge" value="([0-9a-f]+)"`)
+
+func TestChallengeSolved(t *testing.T) {
+	f := newChallengeTestServer(t)
+
+	response := serveChallengeRequest(f, "GET", "http://garbage/account?tab=1", "1.2.3.4", nil)
+	if response.Code != http.StatusForbidden || !strings.Contains(response.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected challenge page, got %d %q", response.Code, response.Header().Get("Content-Type"))
+	}
+	match := challengeInPage.FindStringSubmatch(response.Body.String())
+	if match == nil {
+		t.Fatalf("No challenge in page %q", response.Body.String())
+	}
+	challenge := match[1]
+
+	// wrong nonce, challenge is used up after a wrong answer too
+	form := url.Values{"challenge": {challenge}, "nonce": {"garbage"}}
+	for nonce := 0; leadingZeroBits(sha256.Sum256([]byte(challenge+":"+form.Get("nonce")))) >= 8; nonce++ {
+		form.Set("nonce", strconv.Itoa(nonce))
+	}
+	if response := serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/challenge", "1.2.3.4", form); response.Code != http.StatusForbidden {
+		t.Errorf("Wrong solution should be rejected, got %d", response.Code)
+	}
+	info, _ := f.inspectClient("1.2.3.4")
+	if info.FailCounter != 4 {
+		t.Errorf("Wrong solution should count as a failure, got %d failures", info.FailCounter)
+	}
+	ref := info.BanReference
+
+	response = serveChallengeRequest(f, "GET", "http://garbage/account?tab=1", "1.2.3.4", nil)
+	challenge = challengeInPage.FindStringSubmatch(response.Body.String())[1]
+	form = url.Values{
+		"challenge": {challenge},
+		"nonce":     {solveChallenge(challenge, 8)},
+		"return":    {"/account?tab=1"},
+	}
+
+	// solved by a different client
+	if response := serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/challenge", "5.6.7.8", form); response.Code != http.StatusForbidden {
+		t.Errorf("Challenge should be bound to the client, got %d", response.Code)
+	}
+
+	response = serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/challenge", "1.2.3.4", form)
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/account?tab=1" {
+		t.Fatalf("Expected redirect back, got %d %q", response.Code, response.Header().Get("Location"))
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "fail2ban_pass" || !cookies[0].HttpOnly {
+		t.Fatalf("Expected pass cookie, got %v", cookies)
+	}
+
+	if info, _ := f.inspectClient("1.2.3.4"); info.Banned || info.FailCounter != 0 {
+		t.Errorf("Solving the challenge should lift the ban, got %+v", info)
+	}
+	if response := serveChallengeRequest(f, "GET", "http://garbage/account", "1.2.3.4", nil, cookies[0]); response.Code != http.StatusOK {
+		t.Errorf("Client with pass should get through, got %d", response.Code)
+	}
+	// the pass only covers the ban it was solved for, eg when that ban comes
+	// back from a peer, not a later one
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 2, banRef: ref}
+	if response := serveChallengeRequest(f, "GET", "http://garbage/account", "1.2.3.4", nil, cookies[0]); response.Code != http.StatusOK {
+		t.Errorf("Pass should let the client past the ban it solved, got %d", response.Code)
+	}
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 2, banRef: "later"}
+	if response := serveChallengeRequest(f, "GET", "http://garbage/account", "1.2.3.4", nil, cookies[0]); response.Code != http.StatusForbidden {
+		t.Errorf("Pass should not cover a later ban, got %d", response.Code)
+	}
+	memory(f).clients["5.6.7.8"] = &client{lastViewed: time.Now(), failCounter: 2}
+	if response := serveChallengeRequest(f, "GET", "http://garbage/account", "5.6.7.8", nil, cookies[0]); response.Code != http.StatusForbidden {
+		t.Errorf("Pass should be bound to the client, got %d", response.Code)
+	}
+
+	// replaying the solution doesn't work
+	if response := serveChallengeRequest(f, "POST", "http://garbage/.fail2ban/challenge", "1.2.3.4", form); response.Code != http.StatusForbidden {
+		t.Errorf("Challenge should only be solvable once, got %d", response.Code)
+	}
+
+	stats := f.snapshotStats()
+	if stats.Events[eventChallenge] != 4 || stats.Events[eventChallengePassed] != 1 {
+		t.Errorf("Unexpected events %v", stats.Events)
+	}
+}
+
+func TestChallengeEndpointMethod(t *testing.T) {
+	f := newChallengeTestServer(t)
+	if response := serveChallengeRequest(f, "GET", "http://garbage/.fail2ban/challenge", "1.2.3.4", nil); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d, got %d", http.StatusMethodNotAllowed, response.Code)
+	}
+	if _, ok := f.inspectClient("9.9.9.9"); ok {
+		t.Error("Challenge endpoint should not track clients")
+	}
+}
+
+func TestChallengeExpired(t *testing.T) {
+	p, _ := newProofOfWork(ChallengeConfig{Difficulty: 1, Expiry: "1ns"}, newStats(), nil, nil)
+	challenge, _ := p.newChallenge("1.2.3.4", "ref")
+	time.Sleep(time.Millisecond)
+	if _, ok := p.solve("1.2.3.4", challenge, solveChallenge(challenge, 1)); ok {
+		t.Error("Expired challenge should not be solvable")
+	}
+}
+
+func TestChallengesPerClient(t *testing.T) {
+	p, _ := newProofOfWork(ChallengeConfig{Difficulty: 1}, newStats(), nil, nil)
+	first, _ := p.newChallenge("1.2.3.4", "ref")
+	for idx := 0; idx < maxClientChallenges; idx++ {
+		p.newChallenge("1.2.3.4", "ref")
+	}
+	other, _ := p.newChallenge("5.6.7.8", "ref")
+	if len(p.pending) != maxClientChallenges+1 || len(p.byClient["1.2.3.4"]) != maxClientChallenges {
+		t.Errorf("Expected %d pending challenges for the client, got %d", maxClientChallenges, len(p.byClient["1.2.3.4"]))
+	}
+	if _, ok := p.solve("1.2.3.4", first, solveChallenge(first, 1)); ok {
+		t.Error("Oldest challenge should be replaced")
+	}
+	if ref, ok := p.solve("5.6.7.8", other, solveChallenge(other, 1)); !ok || ref != "ref" {
+		t.Error("Other clients' challenges should be kept")
+	}
+	if _, ok := p.byClient["5.6.7.8"]; ok {
+		t.Error("Solved challenges should be forgotten")
+	}
+}
+
+func TestPassExpired(t *testing.T) {
+	p, _ := newPassIssuer("secret", "", "1ns")
+	response := httptest.NewRecorder()
+	p.issue(response, httptest.NewRequest("GET", "http://garbage", nil), "1.2.3.4", "ref")
+	request := httptest.NewRequest("GET", "http://garbage", nil)
+	request.AddCookie(response.Result().Cookies()[0])
+	time.Sleep(time.Millisecond)
+	if p.valid(request, "1.2.3.4", "ref") {
+		t.Error("Expired pass should not be valid")
+	}
+}
+
+func TestReturnPath(t *testing.T) {
+	tests := map[string]string{
+		"/account?tab=1":       "/account?tab=1",
+		"":                     "/",
+		"https://evil.example": "/",
+		"//evil.example":       "/",
+		"/\\evil.example":      "/",
+	}
+	for target, expected := range tests {
+		if result := returnPath(target); result != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, target, result)
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	var hash [sha256.Size]byte
+	if leadingZeroBits(hash) != 256 {
+		t.Error("All zero hash should have 256 zero bits")
+	}
+	hash[1] = 0x10
+	if leadingZeroBits(hash) != 11 {
+		t.Errorf("Expected 11 zero bits, got %d", leadingZeroBits(hash))
+	}
+}
+
+func TestChallengeConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  ChallengeConfig
+		isError bool
+	}{
+		"defaults":       {ChallengeConfig{}, false},
+		"too difficult":  {ChallengeConfig{Difficulty: 33}, true},
+		"relative path":  {ChallengeConfig{Path: "challenge"}, true},
+		"bad expiry":     {ChallengeConfig{Expiry: "garbage"}, true},
+		"bad cookie ttl": {ChallengeConfig{CookieTTL: "garbage"}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newProofOfWork(test.config, newStats(), nil, nil); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package fail2ban
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// DropConfig closes connections from banned clients without responding
+type DropConfig struct {
+	// Reset sends a TCP RST instead of closing the connection cleanly
+	Reset bool
+}
+
+// Close the connection the request came in on, false when the connection
+// can't be taken over, eg with HTTP/2
+func (f *fail2Ban) dropConnection(rw http.ResponseWriter) bool {
+	conn, _, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return false
+	}
+	if f.drop.Reset {
+		// reset the connection under TLS, closing the TLS connection itself
+		// would send a close alert first
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			conn = tlsConn.NetConn()
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		} else {
+			f.logger.Debugf("Can't reset %T connections, closing instead", conn)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		f.logger.Debugf("Failed to close dropped connection: %s", err)
+	}
+	f.stats.record(eventDrop)
+	return true
+}
+
+// Drop the connection of a banned client, sending the ban response instead
+// when the connection can't be dropped
+func (f *fail2Ban) writeDrop(rw http.ResponseWriter, req *http.Request, ban banDetails) error {
+	if f.dropConnection(rw) {
+		f.logger.Debugf("Dropped connection from %s", ban.IP)
+		return nil
+	}
+	f.logger.Debugf("Can't drop connection from %s, sending ban response", ban.IP)
+	return f.banResponse.write(rw, req, ban)
+}
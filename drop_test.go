@@ -0,0 +1,108 @@
+package fail2ban
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newDropTestServer(t *testing.T, config DropConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:      "1h",
+			LogLevel:     "ERROR",
+			NumberFails:  2,
+			ClientHeader: "client",
+			BanAction:    "drop",
+			Drop:         config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 2}
+	return f
+}
+
+func TestDropConnection(t *testing.T) {
+	for name, config := range map[string]DropConfig{"close": {}, "reset": {Reset: true}} {
+		t.Run(name, func(t *testing.T) {
+			f := newDropTestServer(t, config)
+			server := httptest.NewServer(f)
+			defer server.Close()
+
+			request, _ := http.NewRequest("GET", server.URL, nil)
+			request.Header.Set("client", "1.2.3.4")
+			if response, err := server.Client().Do(request); err == nil {
+				response.Body.Close()
+				t.Errorf("Connection should be dropped, got %d", response.StatusCode)
+			}
+
+			request, _ = http.NewRequest("GET", server.URL, nil)
+			request.Header.Set("client", "5.6.7.8")
+			response, err := server.Client().Do(request)
+			if err != nil {
+				t.Fatalf("Other clients should not be dropped, got %s", err)
+			}
+			response.Body.Close()
+
+			if stats := f.snapshotStats(); stats.Events[eventDrop] != 1 {
+				t.Errorf("Expected 1 drop event, got %d", stats.Events[eventDrop])
+			}
+		})
+	}
+}
+
+func TestDropResetOverTLS(t *testing.T) {
+	f := newDropTestServer(t, DropConfig{Reset: true})
+	server := httptest.NewTLSServer(f)
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("client", "1.2.3.4")
+	response, err := server.Client().Do(request)
+	if err == nil {
+		response.Body.Close()
+		t.Fatalf("Connection should be dropped, got %d", response.StatusCode)
+	}
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected the connection to be reset, got %s", err)
+	}
+}
+
+func TestDropFallsBackWithoutHijacker(t *testing.T) {
+	f := newDropTestServer(t, DropConfig{})
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://garbage", nil)
+	request.Header.Set("client", "1.2.3.4")
+	f.ServeHTTP(response, request)
+	if response.Code != http.StatusForbidden {
+		t.Errorf("Expected response to be %d but got %d", http.StatusForbidden, response.Code)
+	}
+}
+
+func TestDropFallsBackOverHTTP2(t *testing.T) {
+	f := newDropTestServer(t, DropConfig{Reset: true})
+	server := httptest.NewUnstartedServer(f)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("client", "1.2.3.4")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %s", response.Proto)
+	}
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected response to be %d but got %d", http.StatusForbidden, response.StatusCode)
+	}
+}
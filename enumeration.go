@@ -0,0 +1,141 @@
+package fail2ban
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maximum number of path templates tracked per client
+const maxEnumerationTemplates = 16
+
+var uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// EnumerationConfig bans clients walking through resource IDs, eg /api/orders/1001, /api/orders/1002
+type EnumerationConfig struct {
+	// MaxDistinctIDs a client can request per path template per window, 0 disables the check
+	MaxDistinctIDs uint
+	// MaxSequential consecutive numeric IDs a client can request per path template, 0 disables the check
+	MaxSequential uint
+	Window        string
+	// Mode is "enforce" or "monitor", defaults to the top level Mode
+	Mode string
+	// IncludeSuccess counts successful responses as well as 4xx ones
+	IncludeSuccess bool
+}
+
+type enumeration struct {
+	maxIDs         uint
+	maxSequential  uint
+	window         time.Duration
+	includeSuccess bool
+}
+
+func newEnumeration(config EnumerationConfig) (*enumeration, error) {
+	if config.MaxDistinctIDs == 0 && config.MaxSequential == 0 {
+		return nil, nil
+	}
+	window := 10 * time.Minute
+	if len(config.Window) != 0 {
+		d, err := time.ParseDuration(config.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enumeration window: %w", err)
+		}
+		window = d
+	}
+	return &enumeration{
+		maxIDs:         config.MaxDistinctIDs,
+		maxSequential:  config.MaxSequential,
+		window:         window,
+		includeSuccess: config.IncludeSuccess,
+	}, nil
+}
+
+// Replace numeric and UUID path segments with placeholders, returning the
+// template and the IDs that were replaced. ok is false when the path has no IDs.
+func pathTemplate(path string) (template string, ids []string, ok bool) {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		if len(segment) == 0 {
+			continue
+		}
+		if _, err := strconv.ParseUint(segment, 10, 64); err == nil {
+			segments[idx] = "{id}"
+		} else if uuidSegment.MatchString(segment) {
+			segments[idx] = "{uuid}"
+		} else {
+			continue
+		}
+		ids = append(ids, segment)
+	}
+	if len(ids) == 0 {
+		return "", nil, false
+	}
+	return strings.Join(segments, "/"), ids, true
+}
+
+// IDs a client has requested for a single path template
+type idTracker struct {
+	start time.Time
+	ids   map[uint64]struct{}
+	// last numeric ID and how many consecutive IDs lead up to it, going
+	// down when descending is set
+	last       uint64
+	run        uint
+	descending bool
+}
+
+type idTrackers map[string]*idTracker
+
+// Record IDs requested for template, returning the distinct and sequential counts
+func (t *idTrackers) add(now time.Time, template string, ids []string, e *enumeration) (distinct uint, sequential uint) {
+	if *t == nil {
+		*t = make(idTrackers)
+	}
+	tracker := (*t)[template]
+	if tracker == nil || now.After(tracker.start.Add(e.window)) {
+		if tracker == nil && len(*t) >= maxEnumerationTemplates {
+			t.evictOldest()
+		}
+		tracker = &idTracker{start: now, ids: make(map[uint64]struct{})}
+		(*t)[template] = tracker
+	}
+
+	if uint(len(tracker.ids)) < e.maxIDs {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(ids, "/")))
+		tracker.ids[h.Sum64()] = struct{}{}
+	}
+
+	// only the last ID in the path counts towards sequential runs
+	if n, err := strconv.ParseUint(ids[len(ids)-1], 10, 64); err == nil {
+		up, down := n == tracker.last+1, n+1 == tracker.last
+		switch {
+		case tracker.run == 0 || !up && !down && n != tracker.last:
+			tracker.run = 1
+		case n == tracker.last:
+		case tracker.run > 1 && down != tracker.descending:
+			// a run changing direction starts over from the last ID
+			tracker.run = 2
+			tracker.descending = down
+		default:
+			tracker.run++
+			tracker.descending = down
+		}
+		tracker.last = n
+	}
+	return uint(len(tracker.ids)), tracker.run
+}
+
+func (t idTrackers) evictOldest() {
+	var oldest string
+	for template, tracker := range t {
+		if len(oldest) == 0 || tracker.start.Before(t[oldest].start) {
+			oldest = template
+		}
+	}
+	delete(t, oldest)
+}
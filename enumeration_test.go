@@ -0,0 +1,171 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathTemplate(t *testing.T) {
+	tests := map[string]struct {
+		path     string
+		template string
+		ids      []string
+		ok       bool
+	}{
+		"numeric":  {"/api/orders/1001", "/api/orders/{id}", []string{"1001"}, true},
+		"uuid":     {"/users/0b7e4c2a-9f6d-4a51-8c3e-2d1f0a9b8c7d/profile", "/users/{uuid}/profile", []string{"0b7e4c2a-9f6d-4a51-8c3e-2d1f0a9b8c7d"}, true},
+		"multiple": {"/shops/7/orders/12", "/shops/{id}/orders/{id}", []string{"7", "12"}, true},
+		"no ids":   {"/api/orders/latest", "", nil, false},
+		"root":     {"/", "", nil, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			template, ids, ok := pathTemplate(test.path)
+			if ok != test.ok || template != test.template || fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+				t.Errorf("Got %q %v %t", template, ids, ok)
+			}
+		})
+	}
+}
+
+func newEnumerationTestServer(t *testing.T, config EnumerationConfig) (*fail2Ban, *logBuffer) {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "INFO",
+			NumberFails: 1000,
+			Enumeration: config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/1") {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+		}),
+	)
+	buff := &logBuffer{}
+	f.logger.SetOutput(buff)
+	return f, buff
+}
+
+func serveEnumerationRequest(f *fail2Ban, path string) int {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://garbage"+path, nil)
+	request.RemoteAddr = "1.2.3.4:5678"
+	f.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestEnumerationSequential(t *testing.T) {
+	f, logs := newEnumerationTestServer(t, EnumerationConfig{MaxSequential: 5})
+
+	for idx := 1001; idx < 1005; idx++ {
+		if code := serveEnumerationRequest(f, fmt.Sprintf("/api/orders/%d", idx)); code != http.StatusForbidden {
+			t.Errorf("Expected response from downstream, got %d", code)
+		}
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); info.Banned {
+		t.Error("Client should not be banned yet")
+	}
+	serveEnumerationRequest(f, "/api/orders/1005")
+	if info, _ := f.inspectClient("1.2.3.4"); !info.Banned || info.BanRule != ruleEnumeration {
+		t.Errorf("Client should be banned by %q, got %+v", ruleEnumeration, info)
+	}
+	if !strings.Contains(logs.String(), `Banned 1.2.3.4 for enumerating \"/api/orders/{id}\"`) {
+		t.Errorf("Ban should be logged with template, got %q", logs.String())
+	}
+}
+
+func TestIDTrackersSequentialDirection(t *testing.T) {
+	e := &enumeration{maxSequential: 3, window: time.Minute}
+	tests := map[string]struct {
+		ids []int
+		run uint
+	}{
+		"ascending":   {[]int{1, 2, 3, 4}, 4},
+		"descending":  {[]int{9, 8, 7}, 3},
+		"alternating": {[]int{1, 2, 1, 2, 1, 2}, 2},
+		"turning":     {[]int{1, 2, 3, 2, 1}, 3},
+		"repeated":    {[]int{5, 6, 6, 7}, 3},
+		"gap":         {[]int{1, 2, 4, 5}, 2},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			trackers := idTrackers{}
+			var run uint
+			for _, id := range test.ids {
+				_, run = trackers.add(time.Now(), "/{id}", []string{fmt.Sprint(id)}, e)
+			}
+			if run != test.run {
+				t.Errorf("Expected a run of %d but got %d", test.run, run)
+			}
+		})
+	}
+}
+
+func TestEnumerationDistinct(t *testing.T) {
+	f, _ := newEnumerationTestServer(t, EnumerationConfig{MaxDistinctIDs: 10})
+
+	// requesting the same few IDs over and over is fine
+	for idx := 0; idx < 50; idx++ {
+		serveEnumerationRequest(f, fmt.Sprintf("/api/orders/%d", 100+idx%3))
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); info.Banned {
+		t.Error("Client should not be banned")
+	}
+	// random IDs from a different template are not
+	for idx := 0; idx < 10; idx++ {
+		serveEnumerationRequest(f, fmt.Sprintf("/api/invoices/%d", idx*37))
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); !info.Banned || info.BanRule != ruleEnumeration {
+		t.Errorf("Client should be banned by %q, got %+v", ruleEnumeration, info)
+	}
+}
+
+func TestEnumerationIgnoresSuccess(t *testing.T) {
+	f, _ := newEnumerationTestServer(t, EnumerationConfig{MaxDistinctIDs: 2})
+	for idx := 0; idx < 5; idx++ {
+		serveEnumerationRequest(f, fmt.Sprintf("/shops/%d/items/1", idx))
+	}
+	if _, ok := f.inspectClient("1.2.3.4"); ok {
+		t.Error("Successful responses should not be tracked")
+	}
+
+	f, _ = newEnumerationTestServer(t, EnumerationConfig{MaxDistinctIDs: 2, IncludeSuccess: true})
+	for idx := 0; idx < 5; idx++ {
+		serveEnumerationRequest(f, fmt.Sprintf("/shops/%d/items/1", idx))
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); !info.Banned {
+		t.Error("Successful responses should be tracked")
+	}
+}
+
+func TestIDTrackersBounded(t *testing.T) {
+	e := &enumeration{maxIDs: 5, window: time.Minute}
+	trackers := idTrackers{}
+	now := time.Now()
+	for idx := 0; idx < 100; idx++ {
+		trackers.add(now.Add(time.Duration(idx)), fmt.Sprintf("/t%d/{id}", idx), []string{"1"}, e)
+		trackers.add(now, "/same/{id}", []string{fmt.Sprint(idx)}, e)
+	}
+	if len(trackers) > maxEnumerationTemplates {
+		t.Errorf("Should track at most %d templates, got %d", maxEnumerationTemplates, len(trackers))
+	}
+	if tracker, ok := trackers["/same/{id}"]; ok && len(tracker.ids) > 5 {
+		t.Errorf("Should track at most 5 IDs, got %d", len(tracker.ids))
+	}
+
+	e = &enumeration{maxSequential: 5, window: time.Minute}
+	for idx := 0; idx < 100; idx++ {
+		trackers.add(now, "/sequential/{id}", []string{fmt.Sprint(idx)}, e)
+	}
+	if tracker := trackers["/sequential/{id}"]; len(tracker.ids) != 0 {
+		t.Errorf("Should not track IDs without MaxDistinctIDs, got %d", len(tracker.ids))
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"sync"
+	"reflect"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/rauny-henrique/fail2ban/log"
@@ -17,6 +19,34 @@ type Config struct {
 	BanTime      string
 	ClientHeader string
 	LogLevel     log.LogLevel
+	// Mode is "enforce" or "monitor", monitored rules only log the bans they
+	// would make. Rules without their own Mode use this one.
+	Mode string
+	// SharedList names a ban table shared with the other instances using the
+	// same name, each keeps its own fail counters and rules
+	SharedList string
+	// MaxTrackedClients caps how many clients are tracked, 0 is no cap
+	MaxTrackedClients int
+	Bandwidth         BandwidthConfig
+	Scanner           ScannerConfig
+	Enumeration       EnumerationConfig
+	SuccessRules      []SuccessRule
+	Throttle          ThrottleConfig
+	BanResponse       BanResponseConfig
+	// BanAction is one of "block", "redirect", "tarpit", "drop", "challenge" or "captcha"
+	BanAction string
+	Redirect  RedirectConfig
+	Tarpit    TarpitConfig
+	Drop      DropConfig
+	Challenge ChallengeConfig
+	Captcha   CaptchaConfig
+	Annotate  AnnotateConfig
+	GRPC      GRPCConfig
+	State     StateConfig
+	Journal   JournalConfig
+	Redis     RedisConfig
+	Gossip    GossipConfig
+	Stats     StatsConfig
 }
 
 // Create config with reasonable defaults
@@ -26,6 +56,73 @@ func CreateConfig() *Config {
 		BanTime:      "3h",
 		ClientHeader: "Cf-Connecting-IP",
 		LogLevel:     log.Info,
+		Mode:         modeEnforce,
+		Bandwidth: BandwidthConfig{
+			Window: "1h",
+			Action: bandwidthActionThrottle,
+		},
+		Scanner: ScannerConfig{
+			Window: "10m",
+		},
+		Enumeration: EnumerationConfig{
+			Window: "10m",
+		},
+		Throttle: ThrottleConfig{
+			Delay:      "500ms",
+			MaxDelay:   "10s",
+			RetryAfter: "1m",
+		},
+		BanResponse: BanResponseConfig{
+			StatusCode: http.StatusForbidden,
+		},
+		BanAction: banActionBlock,
+		Redirect: RedirectConfig{
+			StatusCode: http.StatusFound,
+		},
+		Tarpit: TarpitConfig{
+			Duration:      "30s",
+			MaxConcurrent: 100,
+			Then:          tarpitThenRespond,
+		},
+		Challenge: ChallengeConfig{
+			Difficulty: 16,
+			Path:       "/.fail2ban/challenge",
+			Expiry:     "5m",
+			CookieName: "fail2ban_pass",
+			CookieTTL:  "1h",
+		},
+		Captcha: CaptchaConfig{
+			Provider:   "turnstile",
+			Path:       "/.fail2ban/captcha",
+			Timeout:    "10s",
+			CookieName: "fail2ban_pass",
+			CookieTTL:  "1h",
+		},
+		Annotate: AnnotateConfig{
+			HeaderPrefix: "X-Fail2ban-",
+			WarnAfter:    1,
+		},
+		GRPC: GRPCConfig{
+			FailureCodes: []int{7, 16},
+		},
+		State: StateConfig{
+			Interval: "1m",
+		},
+		Journal: JournalConfig{
+			MaxBytes: 10 << 20,
+		},
+		Redis: RedisConfig{
+			KeyPrefix: "fail2ban:",
+			Timeout:   "1s",
+			CacheTTL:  "1s",
+			FailMode:  redisFailOpen,
+		},
+		Gossip: GossipConfig{
+			Path:          "/.fail2ban/gossip",
+			Timeout:       "2s",
+			RetryInterval: "5s",
+			QueueSize:     1000,
+		},
 	}
 }
 
@@ -36,15 +133,36 @@ type fail2Ban struct {
 	logger *log.Logger
 
 	// Stuff specific to this plugin
-	maxFails      uint
-	banTime       time.Duration
-	clientHeader  string
-	bannedClients map[string]*client
-	// mutex is specifically access the bannedClients map
-	mu sync.Mutex
+	maxFails     uint
+	banTime      time.Duration
+	clientHeader string
+	// rules which only log the bans they would make
+	monitor map[string]bool
+	// state of every tracked client
+	store        Store
+	bandwidth    *bandwidth
+	scanner      *scanner
+	enumeration  *enumeration
+	successRules []successRule
+	throttle     *throttle
+	banResponse  *banResponse
+	banAction    string
+	redirect     *redirect
+	tarpit       *tarpit
+	drop         DropConfig
+	challenger   challenger
+	annotate     *annotate
+	grpc         *grpc
+	state        *state
+	journal      *journal
+	redis        *redisStore
+	gossip       *gossip
+	sharedList   *banList
+	stats        *stats
+	statsServer  *statsServer
 
 	// this is a test var to signal cleaner is running
-	_cleaning_test_var bool
+	_cleaning_test_var atomic.Bool
 }
 
 func New(ctx context.Context, next http.Handler, config *Config, middleWareName string) (http.Handler, error) {
@@ -52,22 +170,271 @@ func New(ctx context.Context, next http.Handler, config *Config, middleWareName
 	if err != nil {
 		return nil, err
 	}
+	if config.MaxTrackedClients < 0 {
+		return nil, fmt.Errorf("invalid MaxTrackedClients %d", config.MaxTrackedClients)
+	}
+	bw, err := newBandwidth(config.Bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := newScanner(config.Scanner)
+	if err != nil {
+		return nil, err
+	}
+	enum, err := newEnumeration(config.Enumeration)
+	if err != nil {
+		return nil, err
+	}
+	successRules, err := newSuccessRules(config.SuccessRules)
+	if err != nil {
+		return nil, err
+	}
+	th, err := newThrottle(config.Throttle, config.NumberFails)
+	if err != nil {
+		return nil, err
+	}
+	br, err := newBanResponse(config.BanResponse)
+	if err != nil {
+		return nil, err
+	}
+	monitor, err := newMonitoredRules(config)
+	if err != nil {
+		return nil, err
+	}
+	an, err := newAnnotate(config.Annotate)
+	if err != nil {
+		return nil, err
+	}
+	gr, err := newGRPC(config.GRPC)
+	if err != nil {
+		return nil, err
+	}
+	sf, err := newState(config.State)
+	if err != nil {
+		return nil, err
+	}
+	jr, err := newJournal(config.Journal)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := newRedisStore(config.Redis, duration)
+	if err != nil {
+		return nil, err
+	}
+	se, err := newStatsServer(config.Stats)
+	if err != nil {
+		return nil, err
+	}
+	action, err := parseBanAction(config.BanAction)
+	if err != nil {
+		return nil, err
+	}
+	var rd *redirect
+	var tp *tarpit
+	switch action {
+	case banActionRedirect:
+		if rd, err = newRedirect(config.Redirect); err != nil {
+			return nil, err
+		}
+	case banActionTarpit:
+		if tp, err = newTarpit(config.Tarpit); err != nil {
+			return nil, err
+		}
+	}
+	// share the clients and stats of the instances running under this name
+	previous := pinInstance(middleWareName)
+	defer previous.unpin(middleWareName)
+	clients, st := newMemoryStore(), newStats()
+	var latest *fail2Ban
+	if previous != nil {
+		clients, st, latest = previous.clients, previous.stats, previous.latest()
+	}
+	gs, err := newGossip(config.Gossip, duration, st)
+	if err != nil {
+		return nil, err
+	}
 	f := fail2Ban{
-		name:          middleWareName,
-		logger:        log.New("Fail-2-Ban", config.LogLevel),
-		next:          next,
-		maxFails:      config.NumberFails,
-		clientHeader:  config.ClientHeader,
-		banTime:       duration,
-		bannedClients: make(map[string]*client),
+		name:         middleWareName,
+		logger:       log.New("Fail-2-Ban", config.LogLevel),
+		next:         next,
+		maxFails:     config.NumberFails,
+		clientHeader: config.ClientHeader,
+		monitor:      monitor,
+		banTime:      duration,
+		store:        clients,
+		bandwidth:    bw,
+		scanner:      sc,
+		enumeration:  enum,
+		successRules: successRules,
+		throttle:     th,
+		banResponse:  br,
+		banAction:    action,
+		redirect:     rd,
+		tarpit:       tp,
+		drop:         config.Drop,
+		annotate:     an,
+		grpc:         gr,
+		state:        sf,
+		journal:      jr,
+		gossip:       gs,
+		stats:        st,
+		statsServer:  se,
 	}
+	// challenges lift the ban of clients that pass them, so need f to exist first
+	switch action {
+	case banActionChallenge:
+		if f.challenger, err = newProofOfWork(config.Challenge, st, f.clearBan, f.incrementViewCounter); err != nil {
+			return nil, err
+		}
+	case banActionCaptcha:
+		if f.challenger, err = newCaptcha(config.Captcha, st, f.currentBanRef, f.clearBan, f.incrementViewCounter); err != nil {
+			return nil, err
+		}
+	}
+	// keep using the journal, Redis connections and gossip senders of the
+	// latest instance when their settings didn't change, the older instances
+	// may still be serving requests. Only done once the config is known to
+	// be valid.
+	adopted := latest != nil
+	if adopted && jr != nil && latest.journal != nil && latest.journal.path == jr.path {
+		latest.journal.mu.Lock()
+		latest.journal.maxBytes = jr.maxBytes
+		latest.journal.mu.Unlock()
+		jr = latest.journal
+		f.journal = jr
+	}
+	if adopted && rs != nil && latest.redis != nil && latest.redis.client.sameServer(rs.client) {
+		rs.client = latest.redis.client
+	}
+	sharedGossip := adopted && gs != nil && latest.gossip != nil && latest.gossip.banTime == duration &&
+		reflect.DeepEqual(latest.gossip.config, config.Gossip)
+	if sharedGossip {
+		gs = latest.gossip
+		f.gossip = gs
+	}
+	if adopted {
+		f.logger.Infof("Took over %d clients from the running %q instances", clients.Len(), middleWareName)
+	}
+	clients.limit(config.MaxTrackedClients, st, f.logger)
+
 	f.logger.Infof("Max Number Failures %d, Ban Time %q, Client-ID-header %q", f.maxFails, f.banTime, f.clientHeader)
-	go f.cleaner(ctx)
+	if bw != nil {
+		f.logger.Infof("Bandwidth quota %d bytes per %q, ban %t", bw.maxBytes, bw.window, bw.ban)
+	}
+	if sc != nil {
+		f.logger.Infof("Scanner detection after %d distinct failing paths per %q", sc.maxPaths, sc.window)
+	}
+	if enum != nil {
+		f.logger.Infof("Enumeration detection after %d distinct or %d sequential IDs per %q", enum.maxIDs, enum.maxSequential, enum.window)
+	}
+	if len(successRules) != 0 {
+		f.logger.Infof("Loaded %d success rules", len(successRules))
+	}
+	if th != nil {
+		f.logger.Infof("Throttle delaying after %d failures and rejecting after %d failures", th.delayAfter, th.rejectAfter)
+	}
+	f.logger.Infof("Ban action %q", action)
+	if config.MaxTrackedClients != 0 {
+		f.logger.Infof("Tracking at most %d clients, evicting the least recently seen", config.MaxTrackedClients)
+	}
+	if gr != nil {
+		f.logger.Infof("Counting gRPC status codes %v as failures", config.GRPC.FailureCodes)
+	}
+	if an != nil {
+		f.logger.Infof("Annotating requests with %q headers", []string{an.fails, an.maxFails, an.warning, an.rules})
+	}
+	if names := monitoredRuleNames(monitor); len(names) != 0 {
+		f.logger.Infof("Monitoring rules %q, bans they would make are only logged", names)
+	}
+	if se != nil {
+		f.logger.Infof("Serving stats on %q", se.path)
+	}
+	if rd != nil && len(config.Redirect.Secret) == 0 {
+		f.logger.Warn("No redirect secret set, reference tokens can't be verified after a restart")
+	}
+	if rs != nil {
+		f.logger.Infof("Sharing fail counters and bans through Redis at %q, failing %s", config.Redis.Address, rs.failMode())
+		rs.logger = f.logger
+		rs.local = clients
+		f.redis = rs
+		f.store = rs
+	}
+	if sf != nil {
+		f.logger.Infof("Saving state to %q every %q", sf.file, sf.interval)
+		if !adopted {
+			f.loadState()
+		}
+	}
+	if jr != nil {
+		f.logger.Infof("Journaling to %q, compacting past %d bytes", jr.path, jr.maxBytes)
+		jr.mu.Lock()
+		jr.logger = f.logger
+		closed := jr.file == nil
+		jr.mu.Unlock()
+		switch {
+		case !adopted:
+			f.openJournal()
+		case jr != latest.journal || closed:
+			// the clients taken over are what the new journal starts from,
+			// the old instance closed its journal if it stopped by itself
+			if err := f.compactJournal(); err != nil {
+				f.logger.Errorf("Failed to compact journal %q: %s", jr.path, err)
+			}
+		}
+		f.store = &journalStore{Store: f.store, journal: jr}
+	}
+	if len(config.SharedList) != 0 {
+		f.logger.Infof("Sharing bans with every instance using list %q", config.SharedList)
+		// the latest instance already holds the list
+		if adopted && latest.sharedList != nil && latest.sharedList.name == config.SharedList {
+			f.sharedList = latest.sharedList
+		} else {
+			f.sharedList = sharedBanList(config.SharedList)
+		}
+		ss := &sharedStore{Store: f.store, list: f.sharedList, banTime: duration}
+		ss.seed()
+		f.store = ss
+	}
+	var resources []resource
+	if rs != nil {
+		resources = append(resources, rs.client)
+	}
+	if jr != nil {
+		resources = append(resources, jr)
+	}
+	if f.sharedList != nil {
+		resources = append(resources, f.sharedList)
+	}
+	if gs != nil {
+		f.logger.Infof("Gossiping bans with %d peers on %q", len(gs.peers), gs.path)
+		if sharedGossip {
+			gs.use(f.store)
+		} else {
+			gs.logger = f.logger
+			gs.store = f.store
+			gs.start()
+		}
+		f.store = &gossipStore{Store: f.store, gossip: gs}
+		resources = append(resources, gs)
+	}
+	r := registerInstance(middleWareName, previous, &f, clients, resources...)
+	go func() {
+		<-ctx.Done()
+		r.release(middleWareName, &f, resources...)
+	}()
 
 	return &f, err
 }
 
 func (f *fail2Ban) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if f.annotate != nil {
+		f.annotate.strip(req)
+	}
+	// stats requests aren't counted
+	if f.statsServer != nil && req.URL.Path == f.statsServer.path {
+		f.serveStats(rw, req)
+		return
+	}
 	client, err := f.extractClient(req)
 	if err != nil {
 		f.logger.Errorf("Failed to get Client Identifier due to %q, blocking request to be safe", err)
@@ -77,83 +444,327 @@ func (f *fail2Ban) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	f.logger.Debugf("Request from %s", client)
 
-	// block request if client has been banned
-	if f.isClientBanned(client) {
-		rw.WriteHeader(http.StatusForbidden)
+	// messages from peers aren't counted, but banned clients stay blocked
+	if f.gossip != nil && req.URL.Path == f.gossip.path {
+		if ban := f.isClientBanned(client); ban != nil {
+			f.stats.record(eventBlocked)
+			f.writeBanned(rw, req, ban)
+			return
+		}
+		f.gossip.ServeHTTP(rw, req)
+		return
+	}
+
+	// never block or count requests for the page banned clients get
+	// redirected to, otherwise they could end up in a redirect loop
+	if f.redirect != nil && f.redirect.isTarget(req) {
+		f.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if f.challenger != nil && f.challenger.serveChallenge(rw, req, client) {
+		return
+	}
+
+	// block request if client has been banned, unless it passed the
+	// challenge for that ban
+	if !f.hasPass(req, client) {
+		if ban := f.isClientBanned(client); ban != nil {
+			f.stats.record(eventBlocked)
+			f.writeBanned(rw, req, ban)
+			return
+		}
+	}
+
+	// escalate clients getting close to a ban, rejected requests count as
+	// failures so the client keeps moving towards a ban
+	if delay, reject := f.throttleStep(client); reject {
+		f.incrementViewCounter(client)
+		rw.Header().Set("Retry-After", retryAfter(f.throttle.retryAfter))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		return
+	} else if delay > 0 && !sleep(req.Context(), delay) {
+		f.logger.Debugf("Request from %s cancelled while delayed", client)
+		return
+	}
+
+	// slow down clients that used up their bandwidth quota
+	if wait, ok := f.isClientThrottled(client); ok {
+		rw.Header().Set("Retry-After", retryAfter(wait))
+		rw.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
 
 	// intercept returned status code from downstream service(s)
 	i := newIntercept(rw)
-	f.next.ServeHTTP(i, req)
+	i.inspectGRPC = f.grpc != nil
+	f.annotateRequest(client, req)
+	f.next.ServeHTTP(i.writer(), req)
+	if i.hijacked {
+		// whatever was sent went over the raw connection
+		f.logger.Debugf("Connection from %s was hijacked, not evaluating the response", client)
+		return
+	}
+	f.evaluateResponse(client, req, i)
+}
 
-	// check for 4xx class status code
-	if i.checkBadUserRequestStatusCode() {
-		f.incrementViewCounter(client)
+// Update client state from the downstream response
+func (f *fail2Ban) evaluateResponse(ip string, req *http.Request, i *interceptor) {
+	f.logger.Debugf("Response to %s was %d with %d bytes, first byte after %q", ip, i.code, i.bytes, i.firstByte)
+	// check for 4xx class status code or a failing gRPC status
+	failed := i.checkBadUserRequestStatusCode() || (f.grpc != nil && f.grpc.isFailure(i))
+	if failed {
+		f.incrementViewCounter(ip)
+		f.recordFailedPath(ip, req.URL.Path)
+	} else {
+		f.applySuccessRules(ip, req, i)
 	}
+	f.recordEnumeration(ip, req.URL.Path, failed)
+	f.recordBytes(ip, req, i)
 }
 
-func (f *fail2Ban) isClientBanned(ip string) bool {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+// Check if the client is banned, returning details about the ban if it is
+func (f *fail2Ban) isClientBanned(ip string) *banDetails {
 	f.logger.Debugf("Checking for %s", ip)
-	if c, ok := f.bannedClients[ip]; !ok {
-		return false
-	} else if c.failCounter >= f.maxFails {
+	c, ok := f.store.Get(ip)
+	if !ok || !c.isBanned(f.maxFails) {
+		return nil
+	}
+	if c.banRule == ruleUnavailable {
+		// nothing to extend while Redis is down, it is tried again shortly
+		return &banDetails{IP: ip, Reason: ruleUnavailable, Expires: time.Now().Add(redisRetryInterval), Reference: c.banRef}
+	}
+	// a client counting failures while trusted is past the threshold once
+	// the trust expires
+	if len(c.banRule) == 0 && !f.banFails(ip, c) {
+		return nil
+	}
+	if c.hasBanExpired(time.Now(), f.banTime) {
 		// Un-ban
-		if c.hasBanExpired(time.Now(), f.banTime) {
-			f.logger.Infof("Un-Banned %s", ip)
-			delete(f.bannedClients, ip)
-		} else {
-			// extend Ban
-			f.logger.Infof("Extend Ban for %s", ip)
-			c.failCounter++
-			c.lastViewed = time.Now()
-			return true
-		}
+		f.logger.Infof("Un-Banned %s", ip)
+		f.stats.record(eventUnban)
+		f.store.Unban(ip)
+		return nil
 	}
-	return false
+
+	// extend Ban
+	var details *banDetails
+	f.store.Update(ip, false, func(c *client) bool {
+		f.logger.Infof("Extend Ban for %s", ip)
+		c.failCounter++
+		// bans shared by other instances can be seen into the future
+		if now := time.Now(); now.After(c.lastViewed) {
+			c.lastViewed = now
+		}
+		if len(c.banRef) == 0 {
+			c.banRef = newReference()
+			f.logger.Infof("Ban reference %q issued to %s, banned by %q", c.banRef, ip, c.rule())
+		}
+		details = &banDetails{
+			IP:        ip,
+			Reason:    c.rule(),
+			Expires:   c.lastViewed.Add(f.banTime),
+			Reference: c.banRef,
+		}
+		return true
+	})
+	return details
 }
 
 func (f *fail2Ban) incrementViewCounter(ip string) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
 	f.logger.Debugf("Increment %s", ip)
-	if f.bannedClients[ip] == nil {
-		f.bannedClients[ip] = &client{
-			failCounter: 1,
+	c, created := f.store.RecordFailure(ip, time.Now())
+	if created {
+		return
+	}
+	if c.failCounter >= c.threshold(f.maxFails) && len(c.banRule) == 0 {
+		f.banFails(ip, c)
+	}
+}
+
+// Ban a client which reached the failure threshold, returning whether it
+// is banned rather than reported
+func (f *fail2Ban) banFails(ip string, c client) bool {
+	maxFails := c.threshold(f.maxFails)
+	if f.monitor[ruleFails] {
+		// start the client over so repeat offenders get reported again
+		f.wouldBan(ip, ruleFails, fmt.Sprintf("after %d failures", maxFails))
+		f.store.Update(ip, false, func(c *client) bool {
+			c.failCounter = 0
+			c.match(ruleFails)
+			return true
+		})
+		return false
+	}
+	f.logger.Infof("Banned %s after %d failures", ip, maxFails)
+	f.stats.record(eventBan)
+	f.store.Ban(ip, ruleFails, c.lastViewed)
+	return true
+}
+
+// ban clients failing on too many different paths
+func (f *fail2Ban) recordFailedPath(ip string, path string) {
+	if f.scanner == nil {
+		return
+	}
+	now := time.Now()
+	var ban bool
+	f.store.Update(ip, false, func(c *client) bool {
+		if c.isBanned(f.maxFails) || c.paths.add(now, path, f.scanner.maxPaths, f.scanner.window) < f.scanner.maxPaths {
+			return true
+		}
+		if f.monitor[ruleScanner] {
+			f.wouldBan(ip, ruleScanner, fmt.Sprintf("for scanning, failed on %d distinct paths", f.scanner.maxPaths))
+			c.match(ruleScanner)
+			c.paths = pathSet{}
+			return true
+		}
+		ban = true
+		return true
+	})
+	if ban {
+		f.logger.Infof("Banned %s for scanning, failed on %d distinct paths", ip, f.scanner.maxPaths)
+		f.stats.record(eventBan)
+		f.store.Ban(ip, ruleScanner, now)
+	}
+}
+
+// ban clients walking through resource IDs
+func (f *fail2Ban) recordEnumeration(ip string, path string, failed bool) {
+	if f.enumeration == nil || !(failed || f.enumeration.includeSuccess) {
+		return
+	}
+	template, ids, ok := pathTemplate(path)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	var reason string
+	f.store.Update(ip, true, func(c *client) bool {
+		if c.isBanned(f.maxFails) {
+			return true
 		}
+		distinct, sequential := c.enumerations.add(now, template, ids, f.enumeration)
+		if f.enumeration.maxIDs > 0 && distinct >= f.enumeration.maxIDs {
+			reason = fmt.Sprintf("for enumerating %q, requested %d distinct IDs", template, distinct)
+		} else if f.enumeration.maxSequential > 0 && sequential >= f.enumeration.maxSequential {
+			reason = fmt.Sprintf("for enumerating %q, requested %d sequential IDs", template, sequential)
+		} else {
+			return true
+		}
+		if f.monitor[ruleEnumeration] {
+			f.wouldBan(ip, ruleEnumeration, reason)
+			c.match(ruleEnumeration)
+			delete(c.enumerations, template)
+			reason = ""
+		}
+		return true
+	})
+	if len(reason) != 0 {
+		f.logger.Infof("Banned %s %s", ip, reason)
+		f.stats.record(eventBan)
+		f.store.Ban(ip, ruleEnumeration, now)
+	}
+}
+
+func (f *fail2Ban) isClientThrottled(ip string) (time.Duration, bool) {
+	if f.bandwidth == nil {
+		return 0, false
+	}
+	c, ok := f.store.Get(ip)
+	if !ok {
+		return 0, false
+	}
+	wait := c.throttledUntil.Sub(time.Now())
+	return wait, wait > 0
+}
+
+// count response bytes towards the client's bandwidth quota
+func (f *fail2Ban) recordBytes(ip string, req *http.Request, i *interceptor) {
+	if i.bytes == 0 {
+		return
+	}
+	f.stats.addBytes(i.bytes)
+	if f.bandwidth == nil || f.bandwidth.isExempt(req, i.Header()) {
 		return
 	}
-	f.bannedClients[ip].lastViewed = time.Now()
-	f.bannedClients[ip].failCounter++
+	now := time.Now()
+	var ban bool
+	f.store.Update(ip, true, func(c *client) bool {
+		if c.bandwidth.add(now, i.bytes, f.bandwidth.window) <= f.bandwidth.maxBytes || c.isBanned(f.maxFails) {
+			return true
+		}
+		if f.monitor[ruleBandwidth] {
+			if f.bandwidth.ban {
+				f.wouldBan(ip, ruleBandwidth, fmt.Sprintf("for exceeding bandwidth quota, %d bytes sent", c.bandwidth.bytes))
+			} else {
+				f.logger.Infof("Would throttle %s for exceeding bandwidth quota, %d bytes sent, %q is in monitor mode", ip, c.bandwidth.bytes, ruleBandwidth)
+				f.stats.record(eventWouldThrottle)
+			}
+			c.match(ruleBandwidth)
+			// start a new window so the client is reported once per quota
+			c.bandwidth.start, c.bandwidth.bytes = now, 0
+			return true
+		}
+		if f.bandwidth.ban {
+			f.logger.Infof("Banned %s for exceeding bandwidth quota, %d bytes sent", ip, c.bandwidth.bytes)
+			ban = true
+			return true
+		}
+		if c.throttledUntil.Before(now) {
+			f.logger.Infof("Throttling %s for exceeding bandwidth quota, %d bytes sent", ip, c.bandwidth.bytes)
+			f.stats.record(eventThrottle)
+			c.match(ruleBandwidth)
+		}
+		c.throttledUntil = now.Add(c.bandwidth.remaining(now, f.bandwidth.window))
+		return true
+	})
+	if ban {
+		f.stats.record(eventBan)
+		f.store.Ban(ip, ruleBandwidth, now)
+	}
 }
 
-// periodically clean up banned clients
+// periodically clean up banned clients and save the state
 func (f *fail2Ban) cleaner(ctx context.Context) {
 	timer := time.NewTimer(f.banTime / 4)
+	var save <-chan time.Time
+	if f.state != nil {
+		ticker := time.NewTicker(f.state.interval)
+		defer ticker.Stop()
+		save = ticker.C
+	}
+	var compact <-chan struct{}
+	var flush <-chan time.Time
+	if f.journal != nil {
+		compact = f.journal.compact
+		ticker := time.NewTicker(journalSyncInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			f.logger.Info("Shutting down client cleaner")
-			f._cleaning_test_var = false
+			f._cleaning_test_var.Store(false)
 			return
+		case <-save:
+			f.saveState()
+			continue
+		case <-flush:
+			f.journal.sync()
+			continue
+		case <-compact:
+			if err := f.compactJournal(); err != nil {
+				f.logger.Errorf("Failed to compact journal %q: %s", f.journal.path, err)
+			}
+			continue
 		case <-timer.C:
 			f.logger.Debugf("Cleaning up stale client states...")
-			f.mu.Lock()
-			f._cleaning_test_var = true
-			{
-				now := time.Now()
-				for ip, c := range f.bannedClients {
-					if c.hasBanExpired(now, f.banTime) {
-						f.logger.Infof("Clearing out state for %s, it is no longer banned", ip)
-						delete(f.bannedClients, ip)
-					} else {
-						f.logger.Debugf("%s still needs to be tracked", ip)
-					}
-				}
+			f._cleaning_test_var.Store(true)
+			for _, ip := range f.store.Expire(time.Now(), f.banTime) {
+				f.logger.Infof("Clearing out state for %s, it is no longer banned", ip)
 			}
-			f.mu.Unlock()
 		}
 		timer.Reset(f.banTime / 4)
 	}
@@ -173,30 +784,90 @@ func (f *fail2Ban) extractClient(req *http.Request) (string, error) {
 	}
 }
 
-// Intercept Return code from downstream
-type interceptor struct {
-	http.ResponseWriter
-	code int
+// client data tracking struct
+type client struct {
+	lastViewed  time.Time
+	failCounter uint
+	// rule which banned the client, empty when banned for too many failures
+	banRule string
+	// reference support can use to look up the ban
+	banRef         string
+	bandwidth      byteWindow
+	paths          pathSet
+	enumerations   idTrackers
+	throttledUntil time.Time
+	// while trusted the client can fail more often before getting banned
+	trustedUntil    time.Time
+	trustedMaxFails uint
+	// rules which have banned, throttled or would have banned the client
+	matched []string
+	// when the client was last read from Redis
+	fetched time.Time
 }
 
-func newIntercept(w http.ResponseWriter) *interceptor {
-	return &interceptor{w, http.StatusAccepted}
+// names of the rules that can ban a client
+const (
+	ruleFails       = "fails"
+	ruleBandwidth   = "bandwidth"
+	ruleScanner     = "scanner"
+	ruleEnumeration = "enumeration"
+)
+
+func (c client) isBanned(maxFails uint) bool {
+	return c.failCounter >= c.threshold(maxFails) || len(c.banRule) != 0
 }
 
-// Check for for 4xx status code (bad user requests)
-func (i *interceptor) checkBadUserRequestStatusCode() bool {
-	return i.code >= http.StatusBadRequest && i.code < http.StatusInternalServerError
+// Number of failures before the client gets banned
+func (c client) threshold(maxFails uint) uint {
+	if c.trustedMaxFails > maxFails && time.Now().Before(c.trustedUntil) {
+		return c.trustedMaxFails
+	}
+	return maxFails
 }
 
-func (i *interceptor) WriteHeader(code int) {
-	i.code = code
-	i.ResponseWriter.WriteHeader(code)
+// Remember that rule matched the client
+func (c *client) match(rule string) {
+	for _, r := range c.matched {
+		if r == rule {
+			return
+		}
+	}
+	c.matched = append(c.matched, rule)
 }
 
-// client data tracking struct
-type client struct {
-	lastViewed  time.Time
-	failCounter uint
+// Rule responsible for the client's ban
+func (c client) rule() string {
+	if len(c.banRule) != 0 {
+		return c.banRule
+	}
+	return ruleFails
+}
+
+// Retry-After header value, rounded up to whole seconds
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// A duration option of a config section, out keeps its default when value is empty
+type durationOption struct {
+	name  string
+	value string
+	out   *time.Duration
+}
+
+// Parse the duration options of a config section
+func parseDurations(section string, options ...durationOption) error {
+	for _, o := range options {
+		if len(o.value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(o.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %s: %w", section, o.name, err)
+		}
+		*o.out = d
+	}
+	return nil
 }
 
 func (c client) hasBanExpired(currentTime time.Time, d time.Duration) bool {
@@ -1,6 +1,7 @@
 package fail2ban
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net/http"
@@ -8,10 +9,58 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+var testInstances uint64
+
+// Unique middleware name, so tests don't take over each other's clients
+func uniqueName() string {
+	return fmt.Sprintf("test-%d", atomic.AddUint64(&testInstances, 1))
+}
+
+// Create a middleware whose cleaner has already stopped
+func newTestServer(t *testing.T, config *Config, next http.Handler) *fail2Ban {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	return newTestServerContext(t, ctx, config, next)
+}
+
+// Create a middleware running until ctx is done
+func newTestServerContext(t *testing.T, ctx context.Context, config *Config, next http.Handler) *fail2Ban {
+	return newNamedTestServer(t, ctx, uniqueName(), config, next)
+}
+
+// Create a middleware under name, taking over any earlier one with that name
+func newNamedTestServer(t *testing.T, ctx context.Context, name string, config *Config, next http.Handler) *fail2Ban {
+	h, err := New(ctx, next, config, name)
+	if err != nil {
+		t.Errorf("Got error %s", err.Error())
+		t.FailNow()
+	}
+	return h.(*fail2Ban)
+}
+
+// Log output which can be read while the cleaner is still logging
+type logBuffer struct {
+	mu   sync.Mutex
+	buff bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buff.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buff.String()
+}
+
 func TestSeverNotBanned(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.TODO())
 	cancel()
@@ -26,7 +75,7 @@ func TestSeverNotBanned(t *testing.T) {
 			LogLevel:    "ERROR",
 			NumberFails: 3,
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -44,7 +93,7 @@ func TestSeverNotBanned(t *testing.T) {
 			t.Errorf("Expected response to be %d but got %d", http.StatusOK, response.Code)
 		}
 		// Should not get banned with 100 StatusOK responses
-		if len(f.bannedClients) != 0 && f.bannedClients["1.2.3.4"] != nil {
+		if len(memory(f).clients) != 0 && memory(f).clients["1.2.3.4"] != nil {
 			t.Error("Client should not get banned")
 		}
 	}
@@ -64,7 +113,7 @@ func TestSeverBanned(t *testing.T) {
 			LogLevel:    "ERROR",
 			NumberFails: 3,
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -89,7 +138,7 @@ func TestSeverBanned(t *testing.T) {
 			}
 		}
 		// Client should get added to ban list
-		if len(f.bannedClients) != 1 || f.bannedClients["1.2.3.4"].failCounter != idx+1 {
+		if len(memory(f).clients) != 1 || memory(f).clients["1.2.3.4"].failCounter != idx+1 {
 			t.Error("Client should get banned")
 		}
 	}
@@ -103,7 +152,7 @@ func TestSeverBanned(t *testing.T) {
 	if response.Code != http.StatusNotFound {
 		t.Errorf("Expected response to be %d but got %d", http.StatusNotFound, response.Code)
 	}
-	if len(f.bannedClients) != 1 && f.bannedClients["1.2.3.4"].failCounter != 1 {
+	if len(memory(f).clients) != 1 && memory(f).clients["1.2.3.4"].failCounter != 1 {
 		t.Error("Client should not get banned")
 	}
 }
@@ -131,7 +180,7 @@ func TestSeverMultipleClientsAtOnce(t *testing.T) {
 			ClientHeader: "header",
 			NumberFails:  3,
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -152,7 +201,7 @@ func TestSeverMultipleClientsAtOnce(t *testing.T) {
 
 				h.ServeHTTP(response, request)
 
-				f.mu.Lock()
+				memory(f).mu.Lock()
 				if client%2 == 0 {
 					// First few requests will be fine, will get banned after NumberFails is reached
 					if idx < f.maxFails {
@@ -165,7 +214,7 @@ func TestSeverMultipleClientsAtOnce(t *testing.T) {
 						}
 					}
 					// Client should get added to ban list
-					if f.bannedClients[clientId].failCounter != idx+1 {
+					if memory(f).clients[clientId].failCounter != idx+1 {
 						t.Errorf("Client fail counter should get increased")
 					}
 				} else {
@@ -173,15 +222,15 @@ func TestSeverMultipleClientsAtOnce(t *testing.T) {
 						t.Error("Client should not get banned")
 					}
 				}
-				f.mu.Unlock()
+				memory(f).mu.Unlock()
 			}
 
 		}(client)
 	}
 	wg.Wait()
 
-	if len(f.bannedClients) != (numClients/2 + numClients%2) {
-		t.Errorf("Half of the clients should get banned but only %d out of %d did", len(f.bannedClients), numClients)
+	if len(memory(f).clients) != (numClients/2 + numClients%2) {
+		t.Errorf("Half of the clients should get banned but only %d out of %d did", len(memory(f).clients), numClients)
 	}
 }
 
@@ -197,7 +246,7 @@ func TestCheckViewCounter(t *testing.T) {
 			LogLevel:    "ERROR",
 			NumberFails: 3,
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -206,32 +255,32 @@ func TestCheckViewCounter(t *testing.T) {
 
 	f := h.(*fail2Ban)
 	// Client 1 is banned
-	f.bannedClients["1"] = &client{
+	memory(f).clients["1"] = &client{
 		lastViewed:  time.Now(),
 		failCounter: 10,
 	}
 	// Client 2 is no banned
-	f.bannedClients["2"] = &client{
+	memory(f).clients["2"] = &client{
 		lastViewed:  time.Now(),
 		failCounter: 1,
 	}
 
-	if f.isClientBanned("0") {
+	if f.isClientBanned("0") != nil {
 		t.Error("Client 0 should not be banned")
 	}
-	if !f.isClientBanned("1") {
+	if f.isClientBanned("1") == nil {
 		t.Error("Client 1 should be banned")
 	}
-	if f.bannedClients["1"].failCounter != 11 {
+	if memory(f).clients["1"].failCounter != 11 {
 		t.Error("Should have incremented failed views")
 	}
-	if f.isClientBanned("2") {
+	if f.isClientBanned("2") != nil {
 		t.Error("Client 2 should not be banned")
 	}
 
 	// Unban Client 1
-	f.bannedClients["1"].lastViewed = f.bannedClients["1"].lastViewed.Add(-f.banTime).Add(-time.Microsecond)
-	if f.isClientBanned("1") {
+	memory(f).clients["1"].lastViewed = memory(f).clients["1"].lastViewed.Add(-f.banTime).Add(-time.Microsecond)
+	if f.isClientBanned("1") != nil {
 		t.Error("Client 1 should be unbanned")
 	}
 }
@@ -247,7 +296,7 @@ func TestIncrementingViewCounter(t *testing.T) {
 			BanTime:     "1s",
 			NumberFails: 3,
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -256,7 +305,7 @@ func TestIncrementingViewCounter(t *testing.T) {
 
 	f := h.(*fail2Ban)
 
-	if len(f.bannedClients) != 0 {
+	if len(memory(f).clients) != 0 {
 		t.Error("Banned client map should be empty")
 	}
 
@@ -268,28 +317,28 @@ func TestIncrementingViewCounter(t *testing.T) {
 	f.incrementViewCounter("3")
 	f.incrementViewCounter("3")
 
-	if len(f.bannedClients) != 3 {
+	if len(memory(f).clients) != 3 {
 		t.Error("Banned client map should have 3 clients")
 	}
 
-	if f.bannedClients["1"].failCounter != 1 {
+	if memory(f).clients["1"].failCounter != 1 {
 		t.Error("Client 1 should have 1 view")
 	}
-	if f.bannedClients["1"].lastViewed.After(start) {
+	if memory(f).clients["1"].lastViewed.After(start) {
 		t.Error("Client 1 view time should be set to after test start time")
 	}
 
-	if f.bannedClients["2"].failCounter != 1 {
+	if memory(f).clients["2"].failCounter != 1 {
 		t.Error("Client 2 should have 1 view")
 	}
-	if f.bannedClients["2"].lastViewed.After(start) {
+	if memory(f).clients["2"].lastViewed.After(start) {
 		t.Error("Client 2 view time should be set to after test start time")
 	}
 
-	if f.bannedClients["3"].failCounter != 2 {
+	if memory(f).clients["3"].failCounter != 2 {
 		t.Error("Client 3 should have 1 view")
 	}
-	if !f.bannedClients["3"].lastViewed.After(start) {
+	if !memory(f).clients["3"].lastViewed.After(start) {
 		t.Error("Client 1 view time should be set to after test start time")
 	}
 }
@@ -305,7 +354,7 @@ func TestCleaner(t *testing.T) {
 			BanTime:  "1us",
 			LogLevel: "ERROR",
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -317,74 +366,72 @@ func TestCleaner(t *testing.T) {
 	// Do this to make sure cleaner has enough time to start running
 	waitForCleanerToRun := func(f *fail2Ban) {
 		// Wait for cleaner to loop through twice
-		f.mu.Lock()
-		f._cleaning_test_var = false
-		f.mu.Unlock()
+		memory(f).mu.Lock()
+		f._cleaning_test_var.Store(false)
+		memory(f).mu.Unlock()
 		for {
 			time.Sleep(time.Millisecond)
-			f.mu.Lock()
-			if f._cleaning_test_var {
-				f._cleaning_test_var = false
-				f.mu.Unlock()
+			memory(f).mu.Lock()
+			if f._cleaning_test_var.Load() {
+				f._cleaning_test_var.Store(false)
+				memory(f).mu.Unlock()
 				for {
 					time.Sleep(time.Millisecond)
-					f.mu.Lock()
-					if f._cleaning_test_var {
-						f.mu.Unlock()
+					memory(f).mu.Lock()
+					if f._cleaning_test_var.Load() {
+						memory(f).mu.Unlock()
 						return
 					}
-					f.mu.Unlock()
+					memory(f).mu.Unlock()
 				}
 			}
-			f.mu.Unlock()
+			memory(f).mu.Unlock()
 		}
 	}
 	waitForCleanerToRun(f)
 
-	// Change cleaner config and add clients
-	f.mu.Lock()
-	f.banTime = time.Microsecond
-	f.bannedClients = make(map[string]*client)
-	f.bannedClients["1"] = &client{}
-	f.bannedClients["2"] = &client{}
-	f.bannedClients["3"] = &client{}
-	f.bannedClients["4"] = &client{}
-	f.mu.Unlock()
+	// Add clients, the ban time of 1us expires them on the next run
+	memory(f).mu.Lock()
+	memory(f).clients = make(map[string]*client)
+	memory(f).clients["1"] = &client{}
+	memory(f).clients["2"] = &client{}
+	memory(f).clients["3"] = &client{}
+	memory(f).clients["4"] = &client{}
+	memory(f).mu.Unlock()
 
 	// wait for cleaner to clean
 	waitForCleanerToRun(f)
 
 	// pause cleaner
-	f.mu.Lock()
-	if len(f.bannedClients) != 0 {
-		t.Errorf("Failed to clear out banned clients, %d left", len(f.bannedClients))
+	memory(f).mu.Lock()
+	if len(memory(f).clients) != 0 {
+		t.Errorf("Failed to clear out banned clients, %d left", len(memory(f).clients))
 	}
 
-	// Change cleaner config and add clients
-	f.banTime = time.Microsecond
-	f.bannedClients = make(map[string]*client)
-	f.bannedClients["1"] = &client{
+	// Add clients, one of them seen in the future
+	memory(f).clients = make(map[string]*client)
+	memory(f).clients["1"] = &client{
 		lastViewed: time.Now().Add(time.Minute),
 	}
-	f.bannedClients["2"] = &client{}
-	f.bannedClients["3"] = &client{}
-	f.bannedClients["4"] = &client{}
-	f.mu.Unlock()
+	memory(f).clients["2"] = &client{}
+	memory(f).clients["3"] = &client{}
+	memory(f).clients["4"] = &client{}
+	memory(f).mu.Unlock()
 
 	// wait for cleaner to clean
 	waitForCleanerToRun(f)
 
 	// pause cleaner
-	f.mu.Lock()
+	memory(f).mu.Lock()
 
-	if len(f.bannedClients) != 1 {
-		t.Errorf("Should have cleaned all but one client, %d left", len(f.bannedClients))
+	if len(memory(f).clients) != 1 {
+		t.Errorf("Should have cleaned all but one client, %d left", len(memory(f).clients))
 	}
-	if _, ok := f.bannedClients["1"]; !ok {
+	if _, ok := memory(f).clients["1"]; !ok {
 		t.Error("Client 1 should remain uncleaned")
 	}
 
-	f.mu.Unlock()
+	memory(f).mu.Unlock()
 }
 
 func TestCleanerShutsDown(t *testing.T) {
@@ -397,7 +444,7 @@ func TestCleanerShutsDown(t *testing.T) {
 		&Config{
 			BanTime: "1s",
 		},
-		"test",
+		uniqueName(),
 	)
 	if err != nil {
 		t.Errorf("Got error %s", err.Error())
@@ -514,36 +561,31 @@ func TestCheckForInterceptedStatusCode(t *testing.T) {
 	}{
 		"200": {
 			interceptor{
-				nil,
-				200,
+				code: 200,
 			},
 			false,
 		},
 		"300": {
 			interceptor{
-				nil,
-				300,
+				code: 300,
 			},
 			false,
 		},
 		"500": {
 			interceptor{
-				nil,
-				500,
+				code: 500,
 			},
 			false,
 		},
 		"400": {
 			interceptor{
-				nil,
-				400,
+				code: 400,
 			},
 			true,
 		},
 		"499": {
 			interceptor{
-				nil,
-				499,
+				code: 499,
 			},
 			true,
 		},
@@ -565,15 +607,13 @@ func TestHasBanExpired(t *testing.T) {
 	}{
 		"has expired": {
 			client: client{
-				time.Now().Add(-2 * d),
-				0,
+				lastViewed: time.Now().Add(-2 * d),
 			},
 			hasExpired: true,
 		},
 		"has not expired": {
 			client: client{
-				time.Now(),
-				0,
+				lastViewed: time.Now(),
 			},
 			hasExpired: false,
 		},
@@ -0,0 +1,598 @@
+package fail2ban
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rauny-henrique/fail2ban/log"
+)
+
+const (
+	gossipBan   = "ban"
+	gossipUnban = "unban"
+
+	gossipSignatureHeader = "X-Fail2ban-Signature"
+	// largest message accepted from a peer
+	maxGossipBytes = 1 << 20
+	// most events sent in one message, keeping it well below maxGossipBytes.
+	// Syncs swap their snapshots in batches of this size too.
+	maxGossipEvents = 1000
+	// messages sent longer ago than this are rejected as replays
+	maxGossipAge = 5 * time.Minute
+)
+
+// GossipConfig shares bans with other instances without a shared store
+type GossipConfig struct {
+	// Peers are the base URLs of the other instances, eg
+	// "http://traefik-2:8000". Listing this instance as well is fine, so
+	// every instance can use the same list. Empty disables gossip.
+	Peers []string
+	// Secret messages are signed with, must be the same on every peer
+	Secret string
+	// Path peers send messages to, it is handled by the middleware
+	Path string
+	// Timeout for sending a message to a peer
+	Timeout string
+	// RetryInterval between attempts to send to a peer that is down
+	RetryInterval string
+	// QueueSize is how many events are held per peer while it is down,
+	// the oldest are dropped past it
+	QueueSize int
+}
+
+// A client getting banned or unbanned on one of the instances
+type gossipEvent struct {
+	Op   string    `json:"op"`
+	IP   string    `json:"ip"`
+	Rule string    `json:"rule,omitempty"`
+	Ref  string    `json:"ref,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+type gossipMessage struct {
+	// instance which sent the message, so it can ignore its own
+	Node string    `json:"node"`
+	Sent time.Time `json:"sent"`
+	// Sync asks the peer to answer with the bans and unbans it knows about
+	// for clients sorted after After, More is set on the answer when there
+	// are more to come
+	Sync   bool          `json:"sync,omitempty"`
+	After  string        `json:"after,omitempty"`
+	More   bool          `json:"more,omitempty"`
+	Events []gossipEvent `json:"events"`
+}
+
+type gossipPeer struct {
+	url   string
+	queue chan gossipEvent
+}
+
+type gossip struct {
+	// config it was created with, instances with the same one share it
+	config        GossipConfig
+	node          string
+	path          string
+	peers         []*gossipPeer
+	signer        *signer
+	httpClient    *http.Client
+	retryInterval time.Duration
+	banTime       time.Duration
+	logger        *log.Logger
+	stats         *stats
+	// stops the senders and syncs
+	cancel context.CancelFunc
+
+	// mutex protects store and versions
+	mu sync.Mutex
+	// store under the gossip decorator of the latest instance using it,
+	// events from peers are applied to it so they don't get sent back out
+	store Store
+	// latest ban or unban of each client, events are merged last writer wins
+	versions map[string]gossipEvent
+}
+
+func newGossip(config GossipConfig, banTime time.Duration, st *stats) (*gossip, error) {
+	if len(config.Peers) == 0 {
+		return nil, nil
+	}
+	if len(config.Secret) == 0 {
+		return nil, errors.New("gossip needs a secret shared by every peer")
+	}
+	path := config.Path
+	if len(path) == 0 {
+		path = "/.fail2ban/gossip"
+	} else if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid gossip path %q, must start with /", path)
+	}
+	queueSize := config.QueueSize
+	if queueSize == 0 {
+		queueSize = 1000
+	} else if queueSize < 0 {
+		return nil, fmt.Errorf("invalid gossip queue size %d", queueSize)
+	}
+	timeout, retryInterval := 2*time.Second, 5*time.Second
+	err := parseDurations("gossip",
+		durationOption{"timeout", config.Timeout, &timeout},
+		durationOption{"retry interval", config.RetryInterval, &retryInterval},
+	)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSigner(config.Secret)
+	if err != nil {
+		return nil, err
+	}
+	g := &gossip{
+		config:        config,
+		node:          newReference(),
+		path:          path,
+		signer:        s,
+		httpClient:    &http.Client{Timeout: timeout},
+		retryInterval: retryInterval,
+		banTime:       banTime,
+		stats:         st,
+		versions:      make(map[string]gossipEvent),
+	}
+	for _, peer := range config.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid gossip peer %q", peer)
+		}
+		g.peers = append(g.peers, &gossipPeer{
+			url:   strings.TrimRight(peer, "/") + path,
+			queue: make(chan gossipEvent, queueSize),
+		})
+	}
+	return g, nil
+}
+
+// Start sending events to peers and catch up on bans they already have,
+// until close is called
+func (g *gossip) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	for _, p := range g.peers {
+		go g.sender(ctx, p)
+		go g.sync(ctx, p)
+	}
+}
+
+// Stop sending events, the ones still queued are dropped
+func (g *gossip) close() {
+	g.cancel()
+}
+
+// Apply events from peers to s from now on
+func (g *gossip) use(s Store) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.store = s
+}
+
+func (g *gossip) target() Store {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.store
+}
+
+// Queue an event made by this instance for every peer
+func (g *gossip) publish(e gossipEvent) {
+	g.mu.Lock()
+	g.versions[e.IP] = e
+	g.mu.Unlock()
+	for _, p := range g.peers {
+		select {
+		case p.queue <- e:
+			continue
+		default:
+		}
+		// full, make room by dropping the oldest event
+		select {
+		case <-p.queue:
+			g.stats.record(eventGossipDropped)
+		default:
+		}
+		select {
+		case p.queue <- e:
+		default:
+			g.stats.record(eventGossipDropped)
+		}
+	}
+}
+
+// Whether the ban should be sent to peers, bans being extended are only
+// resent every quarter of the ban time so peers don't expire them early
+func (g *gossip) stale(ip string, c client) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	last, ok := g.versions[ip]
+	return !ok || last.Op != gossipBan || last.Rule != c.banRule || c.lastViewed.Sub(last.Time) >= g.banTime/4
+}
+
+// Whether removing the client lifts a ban peers should hear about. Bans
+// expire on every instance by themselves, so expiring ones aren't sent.
+func (g *gossip) lifts(c client) bool {
+	return len(c.banRule) != 0 && !c.hasBanExpired(time.Now(), g.banTime)
+}
+
+// Apply an event from a peer unless a later one for the client is known
+func (g *gossip) apply(e gossipEvent) bool {
+	now := time.Now()
+	if e.Time.After(now) {
+		e.Time = now
+	}
+	if len(e.IP) == 0 || (e.Op == gossipBan && now.Sub(e.Time) >= g.banTime) {
+		return false
+	}
+	g.mu.Lock()
+	if last, ok := g.versions[e.IP]; ok && !e.Time.After(last.Time) {
+		g.mu.Unlock()
+		return false
+	}
+	g.versions[e.IP] = e
+	g.mu.Unlock()
+
+	switch e.Op {
+	case gossipBan:
+		if len(e.Rule) == 0 {
+			e.Rule = ruleFails
+		}
+		g.target().Update(e.IP, true, func(c *client) bool {
+			if len(c.banRule) != 0 && !e.Time.After(c.lastViewed) {
+				return true
+			}
+			c.banRule = e.Rule
+			c.banRef = e.Ref
+			c.lastViewed = e.Time
+			c.match(e.Rule)
+			return true
+		})
+		g.logger.Infof("Banned %s for %q on a peer", e.IP, e.Rule)
+	case gossipUnban:
+		// a later ban made here would have won in versions
+		if !g.target().Unban(e.IP) {
+			return false
+		}
+		g.logger.Infof("Un-Banned %s on a peer", e.IP)
+	default:
+		return false
+	}
+	g.stats.record(eventGossipReceived)
+	return true
+}
+
+// Every ban this instance has and every unban it remembers, the latest one
+// for each client sorted by IP so peers can page through them
+func (g *gossip) snapshot() []gossipEvent {
+	latest := make(map[string]gossipEvent)
+	g.target().Range(func(ip string, c client) bool {
+		if len(c.banRule) != 0 {
+			latest[ip] = gossipEvent{Op: gossipBan, IP: ip, Rule: c.banRule, Ref: c.banRef, Time: c.lastViewed}
+		}
+		return true
+	})
+	g.mu.Lock()
+	for ip, e := range g.versions {
+		ban, ok := latest[ip]
+		switch {
+		case e.Op == gossipUnban && (!ok || e.Time.After(ban.Time)):
+			latest[ip] = e
+		case e.Op == gossipBan && ok && e.Rule == ban.Rule:
+			// extending the ban here doesn't make it newer, it would
+			// otherwise win over an unban made since on a peer
+			ban.Time = e.Time
+			latest[ip] = ban
+		}
+	}
+	g.mu.Unlock()
+	events := make([]gossipEvent, 0, len(latest))
+	for _, e := range latest {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].IP < events[j].IP })
+	return events
+}
+
+// Batch of the snapshot for clients sorted after after, and whether there
+// are more
+func (g *gossip) snapshotAfter(after string) ([]gossipEvent, bool) {
+	events := g.snapshot()
+	events = events[sort.Search(len(events), func(i int) bool { return events[i].IP > after }):]
+	if len(events) > maxGossipEvents {
+		return events[:maxGossipEvents], true
+	}
+	return events, false
+}
+
+// Forget unbans older than the ban time, any ban they lifted has expired
+func (g *gossip) expire(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for ip, e := range g.versions {
+		if now.Sub(e.Time) >= g.banTime {
+			delete(g.versions, ip)
+		}
+	}
+}
+
+func (g *gossip) encode(msg gossipMessage) ([]byte, string, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, base64.RawURLEncoding.EncodeToString(g.signer.mac(body)), nil
+}
+
+// Decode a message if its signature is valid and it isn't a replay
+func (g *gossip) decode(body []byte, signature string) (gossipMessage, error) {
+	var msg gossipMessage
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, g.signer.mac(body)) {
+		return msg, errors.New("invalid signature")
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return msg, err
+	}
+	if age := time.Since(msg.Sent); age > maxGossipAge || age < -maxGossipAge {
+		return msg, fmt.Errorf("message sent %s ago", age)
+	}
+	return msg, nil
+}
+
+// Handle messages from peers, answering sync requests with a snapshot
+func (g *gossip) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// anyone can reach the path, unsigned requests aren't worth reading
+	signature := req.Header.Get(gossipSignatureHeader)
+	if len(signature) == 0 {
+		g.reject(rw, req, errors.New("missing signature"))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxGossipBytes))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	msg, err := g.decode(body, signature)
+	if err != nil {
+		g.reject(rw, req, err)
+		return
+	}
+	// this instance is in its own peer list
+	if msg.Node == g.node {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, e := range msg.Events {
+		g.apply(e)
+	}
+	if !msg.Sync {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	events, more := g.snapshotAfter(msg.After)
+	reply, signature, err := g.encode(gossipMessage{Node: g.node, Sent: time.Now(), More: more, Events: events})
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set(gossipSignatureHeader, signature)
+	rw.Write(reply)
+}
+
+// Turn away a message which isn't from a peer. Only logged at debug level,
+// the path is open to anyone so these can be plentiful.
+func (g *gossip) reject(rw http.ResponseWriter, req *http.Request, err error) {
+	g.logger.Debugf("Rejected gossip from %s: %s", req.RemoteAddr, err)
+	g.stats.record(eventGossipRejected)
+	rw.WriteHeader(http.StatusForbidden)
+}
+
+// Send a message to a peer, returning its answer to sync requests
+func (g *gossip) send(ctx context.Context, p *gossipPeer, msg gossipMessage) (*gossipMessage, error) {
+	msg.Node = g.node
+	msg.Sent = time.Now()
+	body, signature, err := g.encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(gossipSignatureHeader, signature)
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("peer answered %d", resp.StatusCode)
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, maxGossipBytes))
+	if err != nil {
+		return nil, err
+	}
+	answer, err := g.decode(reply, resp.Header.Get(gossipSignatureHeader))
+	if err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// Wait for the retry interval, false if the middleware stopped meanwhile
+func (g *gossip) wait(ctx context.Context) bool {
+	timer := time.NewTimer(g.retryInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Send queued events to a peer in batches, retrying while it is down
+func (g *gossip) sender(ctx context.Context, p *gossipPeer) {
+	var batch []gossipEvent
+	failing := false
+	for {
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-p.queue:
+				batch = append(batch, e)
+			}
+		}
+	drain:
+		for len(batch) < maxGossipEvents {
+			select {
+			case e := <-p.queue:
+				batch = append(batch, e)
+			default:
+				break drain
+			}
+		}
+		if _, err := g.send(ctx, p, gossipMessage{Events: batch}); err != nil {
+			if !failing {
+				g.logger.Warnf("Failed to send %d events to %q, retrying every %q: %s", len(batch), p.url, g.retryInterval, err)
+			}
+			failing = true
+			if !g.wait(ctx) {
+				return
+			}
+			continue
+		}
+		if failing {
+			g.logger.Infof("Sent %d events to %q after it came back", len(batch), p.url)
+		}
+		failing = false
+		for range batch {
+			g.stats.record(eventGossipSent)
+		}
+		batch = nil
+	}
+}
+
+// Anti-entropy at startup, swap everything known with the peer. Both
+// snapshots go in batches so no message outgrows maxGossipBytes.
+func (g *gossip) sync(ctx context.Context, p *gossipPeer) {
+	events := g.snapshot()
+	for len(events) != 0 {
+		n := len(events)
+		if n > maxGossipEvents {
+			n = maxGossipEvents
+		}
+		if _, ok := g.syncSend(ctx, p, gossipMessage{Events: events[:n]}); !ok {
+			return
+		}
+		events = events[n:]
+	}
+
+	after, synced := "", 0
+	for {
+		reply, ok := g.syncSend(ctx, p, gossipMessage{Sync: true, After: after})
+		if !ok {
+			return
+		}
+		// this instance is in its own peer list
+		if reply == nil {
+			return
+		}
+		for _, e := range reply.Events {
+			g.apply(e)
+		}
+		synced += len(reply.Events)
+		if !reply.More || len(reply.Events) == 0 {
+			break
+		}
+		after = reply.Events[len(reply.Events)-1].IP
+	}
+	g.logger.Debugf("Synced %d events from %q", synced, p.url)
+}
+
+// Send a sync message until the peer takes it, false if the middleware
+// stopped meanwhile
+func (g *gossip) syncSend(ctx context.Context, p *gossipPeer, msg gossipMessage) (*gossipMessage, bool) {
+	for {
+		reply, err := g.send(ctx, p, msg)
+		if err == nil {
+			return reply, true
+		}
+		g.logger.Debugf("Failed to sync with %q: %s", p.url, err)
+		if !g.wait(ctx) {
+			return nil, false
+		}
+	}
+}
+
+// Sends bans and unbans made by this instance to its peers
+type gossipStore struct {
+	Store
+	gossip *gossip
+}
+
+func (s *gossipStore) Ban(ip string, rule string, now time.Time) {
+	s.Store.Ban(ip, rule, now)
+	if c, ok := s.Store.Get(ip); ok && len(c.banRule) != 0 {
+		s.gossip.publish(gossipEvent{Op: gossipBan, IP: ip, Rule: c.banRule, Ref: c.banRef, Time: c.lastViewed})
+	}
+}
+
+func (s *gossipStore) Unban(ip string) bool {
+	c, _ := s.Store.Get(ip)
+	ok := s.Store.Unban(ip)
+	if ok && s.gossip.lifts(c) {
+		s.gossip.publish(gossipEvent{Op: gossipUnban, IP: ip, Time: time.Now()})
+	}
+	return ok
+}
+
+func (s *gossipStore) Update(ip string, create bool, fn func(c *client) bool) bool {
+	var before, after client
+	kept := true
+	ok := s.Store.Update(ip, create, func(c *client) bool {
+		before = *c
+		kept = fn(c)
+		after = *c
+		return kept
+	})
+	switch {
+	case !ok:
+	case !kept || len(after.banRule) == 0:
+		if s.gossip.lifts(before) {
+			s.gossip.publish(gossipEvent{Op: gossipUnban, IP: ip, Time: time.Now()})
+		}
+	case s.gossip.stale(ip, after):
+		s.gossip.publish(gossipEvent{Op: gossipBan, IP: ip, Rule: after.banRule, Ref: after.banRef, Time: after.lastViewed})
+	}
+	return ok
+}
+
+func (s *gossipStore) Expire(now time.Time, banTime time.Duration) []string {
+	s.gossip.expire(now)
+	return s.Store.Expire(now, banTime)
+}
@@ -0,0 +1,284 @@
+package fail2ban
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Handler set after the server starts, so peers can know each other's URLs
+type lateHandler struct {
+	mu      sync.Mutex
+	handler http.Handler
+}
+
+func (l *lateHandler) set(h http.Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handler = h
+}
+
+func (l *lateHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	l.mu.Lock()
+	h := l.handler
+	l.mu.Unlock()
+	if h == nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	h.ServeHTTP(rw, req)
+}
+
+func newGossipTestServer(t *testing.T, ctx context.Context, peers ...string) *fail2Ban {
+	config := CreateConfig()
+	config.LogLevel = "ERROR"
+	config.BanTime = "1h"
+	config.Gossip.Peers = peers
+	config.Gossip.Secret = "secret"
+	config.Gossip.RetryInterval = "10ms"
+	return newTestServerContext(t, ctx, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+// Wait up to a second for condition to hold
+func eventually(condition func() bool) bool {
+	for idx := 0; idx < 100; idx++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestGossipBans(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	var handlerA, handlerB lateHandler
+	serverA := httptest.NewServer(&handlerA)
+	defer serverA.Close()
+	serverB := httptest.NewServer(&handlerB)
+	defer serverB.Close()
+	// both instances share the same peer list, including themselves
+	a := newGossipTestServer(t, ctx, serverA.URL, serverB.URL)
+	handlerA.set(a)
+	b := newGossipTestServer(t, ctx, serverA.URL, serverB.URL)
+	handlerB.set(b)
+
+	a.store.Ban("1.1.1.1", ruleScanner, time.Now())
+	if !eventually(func() bool { return b.isClientBanned("1.1.1.1") != nil }) {
+		t.Fatal("Ban should have reached the other instance")
+	}
+	info, _ := b.inspectClient("1.1.1.1")
+	if info.BanRule != ruleScanner {
+		t.Errorf("Expected the %s rule to be shared but got %q", ruleScanner, info.BanRule)
+	}
+
+	// lifting the ban early, eg by solving a CAPTCHA, is shared too
+	b.clearBan("1.1.1.1", info.BanReference)
+	if !eventually(func() bool { return a.isClientBanned("1.1.1.1") == nil }) {
+		t.Fatal("Unban should have reached the other instance")
+	}
+
+	// a new instance catches up on existing bans when it starts
+	a.store.Ban("2.2.2.2", ruleBandwidth, time.Now())
+	c := newGossipTestServer(t, ctx, serverA.URL)
+	if !eventually(func() bool { return c.isClientBanned("2.2.2.2") != nil }) {
+		t.Error("New instance should have synced existing bans")
+	}
+	if _, ok := c.inspectClient("1.1.1.1"); ok {
+		t.Error("New instance should not have synced a lifted ban")
+	}
+}
+
+func TestGossipSyncBatches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	var handlerA, handlerB lateHandler
+	serverA := httptest.NewServer(&handlerA)
+	defer serverA.Close()
+	serverB := httptest.NewServer(&handlerB)
+	defer serverB.Close()
+
+	// more bans on each side than fit in one message
+	ban := func(f *fail2Ban, prefix string, n int) {
+		memory(f).mu.Lock()
+		defer memory(f).mu.Unlock()
+		for idx := 0; idx < n; idx++ {
+			memory(f).clients[fmt.Sprintf("%s.%d.%d", prefix, idx/256, idx%256)] = &client{lastViewed: time.Now(), banRule: ruleScanner}
+		}
+	}
+	a := newGossipTestServer(t, ctx, serverB.URL)
+	ban(a, "10.0", maxGossipEvents+500)
+	handlerA.set(a)
+	b := newGossipTestServer(t, ctx, serverA.URL)
+	ban(b, "10.1", maxGossipEvents+200)
+	handlerB.set(b)
+
+	total := 2*maxGossipEvents + 700
+	if !eventually(func() bool { return a.store.Len() == total && b.store.Len() == total }) {
+		t.Errorf("Expected both instances to have synced %d bans but got %d and %d", total, a.store.Len(), b.store.Len())
+	}
+}
+
+func TestGossipLastWriterWins(t *testing.T) {
+	f := newGossipTestServer(t, context.TODO(), "http://127.0.0.1:1")
+	now := time.Now()
+	apply := func(op string, at time.Time) bool {
+		return f.gossip.apply(gossipEvent{Op: op, IP: "1.1.1.1", Rule: ruleScanner, Time: at})
+	}
+
+	if !apply(gossipBan, now.Add(-time.Minute)) {
+		t.Error("First ban should have been applied")
+	}
+	if apply(gossipUnban, now.Add(-2*time.Minute)) {
+		t.Error("Unban older than the ban should have been ignored")
+	}
+	if f.isClientBanned("1.1.1.1") == nil {
+		t.Error("Client should still be banned")
+	}
+	if !apply(gossipUnban, now) {
+		t.Error("Later unban should have been applied")
+	}
+	if apply(gossipBan, now.Add(-time.Second)) {
+		t.Error("Ban older than the unban should have been ignored")
+	}
+	if f.isClientBanned("1.1.1.1") != nil {
+		t.Error("Client should not be banned")
+	}
+	if apply(gossipBan, now.Add(-2*time.Hour)) {
+		t.Error("Expired ban should have been ignored")
+	}
+}
+
+func TestGossipSnapshotExtendedBan(t *testing.T) {
+	f := newGossipTestServer(t, context.TODO(), "http://127.0.0.1:1")
+	banned := time.Now().Add(-time.Minute)
+	f.gossip.apply(gossipEvent{Op: gossipBan, IP: "1.1.1.1", Rule: ruleScanner, Time: banned})
+
+	// blocking the client extends the ban here
+	if f.isClientBanned("1.1.1.1") == nil {
+		t.Fatal("Client should be banned")
+	}
+	if events := f.gossip.snapshot(); len(events) != 1 || !events[0].Time.Equal(banned) {
+		t.Errorf("Expected the ban to be synced with the time it was made but got %+v", events)
+	}
+}
+
+func TestGossipHandler(t *testing.T) {
+	f := newGossipTestServer(t, context.TODO(), "http://127.0.0.1:1")
+	other, _ := newGossip(GossipConfig{Peers: []string{"http://127.0.0.1:1"}, Secret: "other", Path: "/", Timeout: "1s", RetryInterval: "1s", QueueSize: 1}, time.Hour, newStats())
+	ban := []gossipEvent{{Op: gossipBan, IP: "1.1.1.1", Rule: ruleScanner, Time: time.Now()}}
+
+	tests := map[string]struct {
+		method   string
+		sign     *gossip
+		unsigned bool
+		msg      gossipMessage
+		expected int
+	}{
+		"unsigned":     {method: http.MethodPost, sign: f.gossip, unsigned: true, msg: gossipMessage{Sent: time.Now(), Events: ban}, expected: http.StatusForbidden},
+		"get":          {method: http.MethodGet, sign: f.gossip, expected: http.StatusMethodNotAllowed},
+		"wrong secret": {method: http.MethodPost, sign: other, msg: gossipMessage{Sent: time.Now(), Events: ban}, expected: http.StatusForbidden},
+		"replayed":     {method: http.MethodPost, sign: f.gossip, msg: gossipMessage{Sent: time.Now().Add(-time.Hour), Events: ban}, expected: http.StatusForbidden},
+		"events":       {method: http.MethodPost, sign: f.gossip, msg: gossipMessage{Node: "peer", Sent: time.Now(), Events: ban}, expected: http.StatusNoContent},
+		"sync":         {method: http.MethodPost, sign: f.gossip, msg: gossipMessage{Node: "peer", Sent: time.Now(), Sync: true, Events: ban}, expected: http.StatusOK},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, signature, _ := test.sign.encode(test.msg)
+			req := httptest.NewRequest(test.method, "/.fail2ban/gossip", bytes.NewReader(body))
+			if !test.unsigned {
+				req.Header.Set(gossipSignatureHeader, signature)
+			}
+			rw := httptest.NewRecorder()
+			f.ServeHTTP(rw, req)
+			if rw.Code != test.expected {
+				t.Errorf("Expected status %d but got %d", test.expected, rw.Code)
+			}
+			if rw.Code == http.StatusOK {
+				reply, err := f.gossip.decode(rw.Body.Bytes(), rw.Header().Get(gossipSignatureHeader))
+				if err != nil || len(reply.Events) != 1 || reply.Events[0].IP != "1.1.1.1" {
+					t.Errorf("Expected a signed snapshot with the ban but got %+v, error %v", reply, err)
+				}
+			}
+		})
+	}
+	if f.stats.events[eventGossipRejected] != 3 {
+		t.Errorf("Expected 3 rejected messages but got %d", f.stats.events[eventGossipRejected])
+	}
+}
+
+func TestGossipHandlerBanned(t *testing.T) {
+	f := newGossipTestServer(t, context.TODO(), "http://127.0.0.1:1")
+	f.store.Ban("1.2.3.4", ruleFails, time.Now())
+
+	body, signature, _ := f.gossip.encode(gossipMessage{Node: "peer", Sent: time.Now(), Events: []gossipEvent{
+		{Op: gossipUnban, IP: "1.2.3.4", Time: time.Now()},
+	}})
+	req := httptest.NewRequest(http.MethodPost, "/.fail2ban/gossip", bytes.NewReader(body))
+	req.RemoteAddr = "1.2.3.4:5678"
+	req.Header.Set(gossipSignatureHeader, signature)
+	rw := httptest.NewRecorder()
+	f.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d but got %d", http.StatusForbidden, rw.Code)
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); !info.Banned {
+		t.Error("Banned client should not get its message applied")
+	}
+}
+
+func TestGossipQueueBounded(t *testing.T) {
+	st := newStats()
+	g, err := newGossip(GossipConfig{Peers: []string{"http://127.0.0.1:1"}, Secret: "secret", Path: "/gossip", Timeout: "1s", RetryInterval: "1s", QueueSize: 2}, time.Hour, st)
+	if err != nil {
+		t.Fatalf("Got error %s", err)
+	}
+	// no sender is running, so the queue fills up
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+		g.publish(gossipEvent{Op: gossipBan, IP: ip, Time: time.Now()})
+	}
+	queue := g.peers[0].queue
+	if len(queue) != 2 || st.events[eventGossipDropped] != 2 {
+		t.Fatalf("Expected 2 queued and 2 dropped events but got %d and %d", len(queue), st.events[eventGossipDropped])
+	}
+	if e := <-queue; e.IP != "3.3.3.3" {
+		t.Errorf("Expected the oldest events to be dropped but got %s first", e.IP)
+	}
+}
+
+func TestGossipConfig(t *testing.T) {
+	valid := CreateConfig().Gossip
+	valid.Peers = []string{"http://peer:8000"}
+	valid.Secret = "secret"
+	tests := map[string]struct {
+		change func(c *GossipConfig)
+		err    bool
+	}{
+		"disabled":     {change: func(c *GossipConfig) { c.Peers = nil; c.Secret = "" }},
+		"valid":        {change: func(c *GossipConfig) {}},
+		"no secret":    {change: func(c *GossipConfig) { c.Secret = "" }, err: true},
+		"bad peer":     {change: func(c *GossipConfig) { c.Peers = []string{"peer:8000"} }, err: true},
+		"bad path":     {change: func(c *GossipConfig) { c.Path = "gossip" }, err: true},
+		"bad timeout":  {change: func(c *GossipConfig) { c.Timeout = "soon" }, err: true},
+		"bad interval": {change: func(c *GossipConfig) { c.RetryInterval = "often" }, err: true},
+		"bad queue":    {change: func(c *GossipConfig) { c.QueueSize = -1 }, err: true},
+		"defaults": {change: func(c *GossipConfig) {
+			c.Path, c.Timeout, c.RetryInterval, c.QueueSize = "", "", "", 0
+		}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := valid
+			test.change(&config)
+			if _, err := newGossip(config, time.Hour, newStats()); (err != nil) != test.err {
+				t.Errorf("Expected error %t but got %v", test.err, err)
+			}
+		})
+	}
+}
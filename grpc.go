@@ -0,0 +1,200 @@
+package fail2ban
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// highest gRPC status code, UNAUTHENTICATED
+const maxGRPCStatus = 16
+
+// largest gRPC-Web trailer frame kept, anything bigger is not a sane trailer
+const maxGRPCWebTrailers = 8 << 10
+
+// GRPCConfig counts gRPC responses with failing status codes as failures,
+// gRPC always answers 200 so the status code is read from the trailers
+type GRPCConfig struct {
+	// FailureCodes are the gRPC status codes counted as failures, eg 7 for
+	// PERMISSION_DENIED and 16 for UNAUTHENTICATED. Empty disables gRPC support
+	FailureCodes []int
+}
+
+type grpc struct {
+	failures map[int]bool
+}
+
+func newGRPC(config GRPCConfig) (*grpc, error) {
+	if len(config.FailureCodes) == 0 {
+		return nil, nil
+	}
+	g := &grpc{failures: make(map[int]bool)}
+	for _, code := range config.FailureCodes {
+		if code <= 0 || code > maxGRPCStatus {
+			return nil, fmt.Errorf("invalid gRPC failure code %d", code)
+		}
+		g.failures[code] = true
+	}
+	return g, nil
+}
+
+// kinds of gRPC responses, they each carry the status differently
+type grpcKind int
+
+const (
+	grpcNone grpcKind = iota
+	grpcNative
+	grpcWeb
+	grpcWebText
+)
+
+func grpcContentType(contentType string) grpcKind {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return grpcNone
+	}
+	// subtypes like application/grpc-web+proto use the same framing
+	switch {
+	case strings.HasPrefix(mediaType, "application/grpc-web-text"):
+		return grpcWebText
+	case strings.HasPrefix(mediaType, "application/grpc-web"):
+		return grpcWeb
+	case mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+"):
+		return grpcNative
+	default:
+		return grpcNone
+	}
+}
+
+// gRPC status of the intercepted response, ok is false for non gRPC
+// responses and ones which never sent a status
+func (i *interceptor) grpcStatus() (status int, ok bool) {
+	var value string
+	switch grpcContentType(i.Header().Get("Content-Type")) {
+	case grpcNone:
+		return 0, false
+	case grpcWeb, grpcWebText:
+		if i.grpcWeb != nil {
+			value = i.grpcWeb.status()
+		}
+	}
+	// trailers-only responses put the status in the headers, real trailers
+	// end up in the header map once the handler is done
+	if len(value) == 0 {
+		value = i.Header().Get("Grpc-Status")
+	}
+	if len(value) == 0 {
+		value = i.Header().Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	status, err := strconv.Atoi(strings.TrimSpace(value))
+	return status, err == nil
+}
+
+// Check the gRPC status of the response against the failure codes
+func (g *grpc) isFailure(i *interceptor) bool {
+	status, ok := i.grpcStatus()
+	return ok && g.failures[status]
+}
+
+// Reads the trailer frame from a gRPC-Web response body as it is written.
+// Frames are a flag byte, with the top bit set for trailers, a 4 byte big
+// endian length and the payload. grpc-web-text bodies are base64 encoded.
+type grpcWebTrailers struct {
+	text bool
+	// base64 characters waiting for a full quantum
+	quantum    [4]byte
+	quantumLen int
+	// current frame header and how much of its payload is left
+	header    [5]byte
+	headerLen int
+	remaining uint32
+	trailer   bool
+	trailers  []byte
+	complete  bool
+}
+
+func (p *grpcWebTrailers) Write(b []byte) (int, error) {
+	if !p.text {
+		p.frames(b)
+		return len(b), nil
+	}
+	var decoded [3]byte
+	for _, c := range b {
+		if c == '\r' || c == '\n' {
+			continue
+		}
+		p.quantum[p.quantumLen] = c
+		p.quantumLen++
+		if p.quantumLen < len(p.quantum) {
+			continue
+		}
+		p.quantumLen = 0
+		// each message can be padded separately so decode a quantum at a time
+		n, err := base64.StdEncoding.Decode(decoded[:], p.quantum[:])
+		if err != nil {
+			continue
+		}
+		p.frames(decoded[:n])
+	}
+	return len(b), nil
+}
+
+func (p *grpcWebTrailers) frames(b []byte) {
+	for len(b) > 0 {
+		if p.headerLen < len(p.header) {
+			n := copy(p.header[p.headerLen:], b)
+			p.headerLen += n
+			b = b[n:]
+			if p.headerLen == len(p.header) {
+				p.remaining = binary.BigEndian.Uint32(p.header[1:])
+				p.trailer = p.header[0]&0x80 != 0
+				if p.trailer {
+					p.trailers = p.trailers[:0]
+					p.complete = false
+				}
+				p.endFrame()
+			}
+			continue
+		}
+		n := len(b)
+		if uint32(n) > p.remaining {
+			n = int(p.remaining)
+		}
+		if p.trailer && len(p.trailers)+n <= maxGRPCWebTrailers {
+			p.trailers = append(p.trailers, b[:n]...)
+		}
+		p.remaining -= uint32(n)
+		b = b[n:]
+		p.endFrame()
+	}
+}
+
+// Start on the next frame header once the payload has been read
+func (p *grpcWebTrailers) endFrame() {
+	if p.remaining != 0 {
+		return
+	}
+	if p.trailer {
+		p.complete = true
+	}
+	p.headerLen = 0
+}
+
+// Value of grpc-status in the trailer frame, empty until it has been read
+func (p *grpcWebTrailers) status() string {
+	if !p.complete {
+		return ""
+	}
+	for _, line := range bytes.Split(p.trailers, []byte("\n")) {
+		key, value, ok := strings.Cut(string(line), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "grpc-status") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
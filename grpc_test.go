@@ -0,0 +1,136 @@
+package fail2ban
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// gRPC-Web frame with the given flag and payload
+func grpcWebFrame(flag byte, payload string) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func grpcWebBody(status string) []byte {
+	body := grpcWebFrame(0, "\x0a\x05hello")
+	return append(body, grpcWebFrame(0x80, "grpc-status: "+status+"\r\ngrpc-message: nope\r\n")...)
+}
+
+func TestGRPCFailures(t *testing.T) {
+	tests := map[string]struct {
+		handler func(w http.ResponseWriter)
+		failed  bool
+	}{
+		"trailer unauthenticated": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(http.StatusOK)
+			w.Write(grpcWebFrame(0, "hello"))
+			w.Header().Set("Grpc-Status", "16")
+		}, true},
+		"trailer prefix": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc+proto")
+			w.Write(grpcWebFrame(0, "hello"))
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "7")
+		}, true},
+		"trailers only": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "7")
+			w.WriteHeader(http.StatusOK)
+		}, true},
+		"ok": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write(grpcWebFrame(0, "hello"))
+			w.Header().Set("Grpc-Status", "0")
+		}, false},
+		"not a failure code": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "5")
+		}, false},
+		"not grpc": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Grpc-Status", "16")
+		}, false},
+		"grpc web": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc-web+proto")
+			w.Write(grpcWebBody("16"))
+		}, true},
+		"grpc web ok": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc-web")
+			w.Write(grpcWebBody("0"))
+		}, false},
+		"grpc web byte by byte": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc-web")
+			for _, b := range grpcWebBody("7") {
+				w.Write([]byte{b})
+			}
+		}, true},
+		"grpc web text": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc-web-text")
+			// each frame is encoded and padded separately
+			w.Write([]byte(base64.StdEncoding.EncodeToString(grpcWebFrame(0, "\x0a\x05hello"))))
+			w.Write([]byte(base64.StdEncoding.EncodeToString(grpcWebFrame(0x80, "grpc-status:16\r\n"))))
+		}, true},
+		"grpc web text ok": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc-web-text+proto")
+			w.Write([]byte(base64.StdEncoding.EncodeToString(grpcWebBody("0"))))
+		}, false},
+		"http failure": {func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.WriteHeader(http.StatusNotFound)
+		}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := newTestServer(
+				t,
+				&Config{
+					BanTime:     "1h",
+					LogLevel:    "ERROR",
+					NumberFails: 3,
+					GRPC:        GRPCConfig{FailureCodes: []int{7, 16}},
+				},
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					test.handler(w)
+				}),
+			)
+
+			request := httptest.NewRequest("POST", "http://garbage/helloworld.Greeter/SayHello", nil)
+			request.RemoteAddr = "1.2.3.4:5678"
+			f.ServeHTTP(httptest.NewRecorder(), request)
+			if _, failed := f.inspectClient("1.2.3.4"); failed != test.failed {
+				t.Errorf("Expected failure %t but got %t", test.failed, failed)
+			}
+		})
+	}
+}
+
+func TestGRPCConfig(t *testing.T) {
+	tests := map[string]struct {
+		codes   []int
+		enabled bool
+		isError bool
+	}{
+		"disabled":  {nil, false, false},
+		"defaults":  {[]int{7, 16}, true, false},
+		"ok":        {[]int{0}, false, true},
+		"too large": {[]int{17}, false, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			g, err := newGRPC(GRPCConfig{FailureCodes: test.codes})
+			if (err != nil) != test.isError {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if (g != nil) != test.enabled {
+				t.Errorf("Expected enabled %t", test.enabled)
+			}
+		})
+	}
+}
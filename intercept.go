@@ -0,0 +1,257 @@
+package fail2ban
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Intercept Return code from downstream
+type interceptor struct {
+	http.ResponseWriter
+	// status code sent, net/http sends 200 when the handler doesn't set one
+	code  int
+	bytes uint64
+	// when the request was forwarded and how long until the response started
+	start     time.Time
+	firstByte time.Duration
+	committed bool
+	// the handler took over the connection, the response is unknown
+	hijacked bool
+	// set when the body should be checked for gRPC-Web trailers
+	inspectGRPC bool
+	grpcWeb     *grpcWebTrailers
+}
+
+func newIntercept(w http.ResponseWriter) *interceptor {
+	return &interceptor{ResponseWriter: w, code: http.StatusOK, start: time.Now()}
+}
+
+// Check for for 4xx status code (bad user requests)
+func (i *interceptor) checkBadUserRequestStatusCode() bool {
+	return i.code >= http.StatusBadRequest && i.code < http.StatusInternalServerError
+}
+
+// Record the status code the response started with, later calls are ignored
+// just like net/http ignores superfluous WriteHeader calls
+func (i *interceptor) commit(code int) {
+	if i.committed {
+		return
+	}
+	i.committed = true
+	i.code = code
+	i.firstByte = time.Since(i.start)
+	if !i.inspectGRPC {
+		return
+	}
+	switch grpcContentType(i.Header().Get("Content-Type")) {
+	case grpcWeb:
+		i.grpcWeb = &grpcWebTrailers{}
+	case grpcWebText:
+		i.grpcWeb = &grpcWebTrailers{text: true}
+	}
+}
+
+func (i *interceptor) WriteHeader(code int) {
+	// informational responses are followed by the real one
+	if code < http.StatusOK && code != http.StatusSwitchingProtocols {
+		i.ResponseWriter.WriteHeader(code)
+		return
+	}
+	i.commit(code)
+	i.ResponseWriter.WriteHeader(code)
+}
+
+func (i *interceptor) Write(b []byte) (int, error) {
+	i.commit(http.StatusOK)
+	n, err := i.ResponseWriter.Write(b)
+	i.bytes += uint64(n)
+	if i.grpcWeb != nil {
+		i.grpcWeb.Write(b[:n])
+	}
+	return n, err
+}
+
+// Only called when the underlying writer is an io.ReaderFrom, see writer
+func (i *interceptor) ReadFrom(r io.Reader) (int64, error) {
+	i.commit(http.StatusOK)
+	if i.grpcWeb != nil {
+		r = io.TeeReader(r, i.grpcWeb)
+	}
+	n, err := i.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	i.bytes += uint64(n)
+	return n, err
+}
+
+// Only called when the underlying writer is an http.Flusher, see writer
+func (i *interceptor) Flush() {
+	i.commit(http.StatusOK)
+	i.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Only called when the underlying writer is an http.Hijacker, see writer
+func (i *interceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := i.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		i.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Only called when the underlying writer is an http.Pusher, see writer
+func (i *interceptor) Push(target string, opts *http.PushOptions) error {
+	return i.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// Lets http.ResponseController find the underlying writer
+func (i *interceptor) Unwrap() http.ResponseWriter {
+	return i.ResponseWriter
+}
+
+type unwrapper interface {
+	Unwrap() http.ResponseWriter
+}
+
+// optional interfaces the underlying writer can implement
+const (
+	canFlush = 1 << iota
+	canHijack
+	canPush
+	canReadFrom
+)
+
+// Writer to hand downstream, implementing exactly the optional interfaces
+// the underlying writer does so handlers checking for them behave the same
+// as without the middleware
+func (i *interceptor) writer() http.ResponseWriter {
+	var supports int
+	if _, ok := i.ResponseWriter.(http.Flusher); ok {
+		supports |= canFlush
+	}
+	if _, ok := i.ResponseWriter.(http.Hijacker); ok {
+		supports |= canHijack
+	}
+	if _, ok := i.ResponseWriter.(http.Pusher); ok {
+		supports |= canPush
+	}
+	if _, ok := i.ResponseWriter.(io.ReaderFrom); ok {
+		supports |= canReadFrom
+	}
+
+	switch supports {
+	case 0:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+		}{i, i}
+	case canFlush:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+		}{i, i, i}
+	case canHijack:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+		}{i, i, i}
+	case canFlush | canHijack:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+		}{i, i, i, i}
+	case canPush:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Pusher
+		}{i, i, i}
+	case canFlush | canPush:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Pusher
+		}{i, i, i, i}
+	case canHijack | canPush:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.Pusher
+		}{i, i, i, i}
+	case canFlush | canHijack | canPush:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{i, i, i, i, i}
+	case canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			io.ReaderFrom
+		}{i, i, i}
+	case canFlush | canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			io.ReaderFrom
+		}{i, i, i, i}
+	case canHijack | canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			io.ReaderFrom
+		}{i, i, i, i}
+	case canFlush | canHijack | canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{i, i, i, i, i}
+	case canPush | canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Pusher
+			io.ReaderFrom
+		}{i, i, i, i}
+	case canFlush | canPush | canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{i, i, i, i, i}
+	case canHijack | canPush | canReadFrom:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{i, i, i, i, i}
+	default:
+		return struct {
+			http.ResponseWriter
+			unwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{i, i, i, i, i, i}
+	}
+}
@@ -0,0 +1,179 @@
+package fail2ban
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writers implementing different sets of optional interfaces
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+type hijackPushWriter struct {
+	http.ResponseWriter
+}
+
+func (hijackPushWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("not a real connection")
+}
+
+func (hijackPushWriter) Push(string, *http.PushOptions) error {
+	return nil
+}
+
+func TestInterceptorInterfaces(t *testing.T) {
+	tests := map[string]struct {
+		writer   http.ResponseWriter
+		flush    bool
+		hijack   bool
+		push     bool
+		readFrom bool
+	}{
+		"plain":       {plainWriter{httptest.NewRecorder()}, false, false, false, false},
+		"recorder":    {httptest.NewRecorder(), true, false, false, false},
+		"hijack push": {hijackPushWriter{httptest.NewRecorder()}, false, true, true, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := newIntercept(test.writer).writer()
+			if _, ok := w.(http.Flusher); ok != test.flush {
+				t.Errorf("Expected Flusher %t", test.flush)
+			}
+			if _, ok := w.(http.Hijacker); ok != test.hijack {
+				t.Errorf("Expected Hijacker %t", test.hijack)
+			}
+			if _, ok := w.(http.Pusher); ok != test.push {
+				t.Errorf("Expected Pusher %t", test.push)
+			}
+			if _, ok := w.(io.ReaderFrom); ok != test.readFrom {
+				t.Errorf("Expected ReaderFrom %t", test.readFrom)
+			}
+			if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+				t.Error("Expected writer to unwrap")
+			}
+		})
+	}
+}
+
+func TestInterceptorServer(t *testing.T) {
+	var i *interceptor
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		i = newIntercept(rw)
+		w := i.writer()
+		// a real HTTP/1.1 connection supports all of these but pushing
+		_, flush := w.(http.Flusher)
+		_, hijack := w.(http.Hijacker)
+		_, push := w.(http.Pusher)
+		readerFrom, readFrom := w.(io.ReaderFrom)
+		if !flush || !hijack || push || !readFrom {
+			t.Errorf("Unexpected interfaces flush %t, hijack %t, push %t, read from %t", flush, hijack, push, readFrom)
+		}
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			t.Errorf("Expected response controller to unwrap the writer, got %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		readerFrom.ReadFrom(strings.NewReader("hello"))
+		w.Write([]byte(" world"))
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello world" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if i.code != http.StatusOK || i.bytes != 11 {
+		t.Errorf("Expected implicit 200 with 11 bytes, got %d with %d bytes", i.code, i.bytes)
+	}
+	if i.firstByte < 10*time.Millisecond {
+		t.Errorf("Expected time to first byte of at least 10ms, got %q", i.firstByte)
+	}
+}
+
+func TestInterceptorHijacked(t *testing.T) {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 3,
+			SuccessRules: []SuccessRule{{
+				Action:             "trust",
+				TrustDuration:      "1h",
+				TrustedNumberFails: 10,
+			}},
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Got error %s", err.Error())
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			rw.Flush()
+		}),
+	)
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if _, ok := f.inspectClient("127.0.0.1"); ok {
+		t.Error("Hijacked connections should not be evaluated")
+	}
+}
+
+func TestInterceptorStatus(t *testing.T) {
+	tests := map[string]struct {
+		handler func(w http.ResponseWriter)
+		code    int
+	}{
+		"nothing written": {func(w http.ResponseWriter) {}, http.StatusOK},
+		"implicit":        {func(w http.ResponseWriter) { w.Write([]byte("ok")) }, http.StatusOK},
+		"flushed":         {func(w http.ResponseWriter) { w.(http.Flusher).Flush() }, http.StatusOK},
+		"explicit": {func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("missing"))
+		}, http.StatusNotFound},
+		"superfluous": {func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusNotFound},
+		"informational": {func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusUnauthorized)
+		}, http.StatusUnauthorized},
+		"write then header": {func(w http.ResponseWriter) {
+			w.Write([]byte("ok"))
+			w.WriteHeader(http.StatusNotFound)
+		}, http.StatusOK},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i := newIntercept(httptest.NewRecorder())
+			test.handler(i.writer())
+			if i.code != test.code {
+				t.Errorf("Expected %d but got %d", test.code, i.code)
+			}
+		})
+	}
+}
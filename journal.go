@@ -0,0 +1,352 @@
+package fail2ban
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rauny-henrique/fail2ban/log"
+)
+
+// journal record operations, compacted journals only hold client records
+const (
+	journalBan     = "ban"
+	journalUnban   = "unban"
+	journalCounter = "counter"
+	journalClient  = "client"
+)
+
+// how often appended records are flushed and synced to disk
+const journalSyncInterval = time.Second
+
+// JournalConfig appends every ban, unban and fail counter change to a file
+// before it is made, so no state is lost between snapshots when the process
+// crashes. Records are synced to disk every second.
+type JournalConfig struct {
+	// File the journal is written to, empty disables the journal
+	File string
+	// MaxBytes the journal can grow to before it is compacted
+	MaxBytes uint64
+}
+
+// A journal line is the CRC-32 of the JSON record in hex, a space and the
+// record. Lines which don't match their checksum are skipped on replay.
+type journalRecord struct {
+	Op     string       `json:"op"`
+	IP     string       `json:"ip"`
+	Time   time.Time    `json:"time"`
+	Client *clientState `json:"client,omitempty"`
+}
+
+type journal struct {
+	path     string
+	maxBytes uint64
+
+	// changes to a client hold its lock from appending the record until the
+	// change is made, so records are in the order changes were made
+	clients clientLocks
+
+	// mutex protects the file
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   uint64
+	// signals the cleaner to compact the journal
+	compact chan struct{}
+	logger  *log.Logger
+	// set while appending fails, so a streak of failures is logged once
+	failing bool
+}
+
+func newJournal(config JournalConfig) (*journal, error) {
+	if len(config.File) == 0 {
+		return nil, nil
+	}
+	j := &journal{
+		path:     config.File,
+		maxBytes: config.MaxBytes,
+		compact:  make(chan struct{}, 1),
+	}
+	if j.maxBytes == 0 {
+		j.maxBytes = 10 << 20
+	}
+	return j, nil
+}
+
+func encodeJournalRecord(r journalRecord) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeJournalRecord(line []byte) (journalRecord, error) {
+	var r journalRecord
+	sum, data, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok {
+		return r, errors.New("missing checksum")
+	}
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) != string(sum) {
+		return r, errors.New("checksum mismatch")
+	}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Read every record in the journal, records which are corrupt or cut short
+// are skipped and counted
+func readJournal(path string, apply func(journalRecord)) (records int, corrupt int, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 {
+			if r, decodeErr := decodeJournalRecord(line); decodeErr != nil || line[len(line)-1] != '\n' {
+				corrupt++
+			} else {
+				records++
+				apply(r)
+			}
+		}
+		if err == io.EOF {
+			return records, corrupt, nil
+		} else if err != nil {
+			return records, corrupt, err
+		}
+	}
+}
+
+// Append a record for a change to a client, c is nil when it was unbanned.
+// Callers hold the client's lock so records are in the order changes were made.
+func (j *journal) append(op string, ip string, c *client) {
+	r := journalRecord{Op: op, IP: ip, Time: time.Now()}
+	if c != nil {
+		state := newClientState(c)
+		r.Client = &state
+	}
+	line, err := encodeJournalRecord(r)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	if err == nil {
+		var n int
+		n, err = j.writer.Write(line)
+		j.size += uint64(n)
+	}
+	if !j.report(err) {
+		return
+	}
+	if j.size > j.maxBytes {
+		select {
+		case j.compact <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Log when appending starts or stops failing, so a streak of failures is
+// logged once. Returns false on failure. Callers hold mu.
+func (j *journal) report(err error) bool {
+	if err != nil {
+		if !j.failing {
+			j.logger.Errorf("Failed to append to journal %q: %s", j.path, err)
+			j.failing = true
+		}
+		return false
+	}
+	if j.failing {
+		j.logger.Infof("Appending to journal %q again", j.path)
+		j.failing = false
+	}
+	return true
+}
+
+// Write out the appended records and sync them to disk
+func (j *journal) sync() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	err := j.writer.Flush()
+	if err == nil {
+		err = j.file.Sync()
+	}
+	j.report(err)
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		if err := j.writer.Flush(); err == nil {
+			j.file.Sync()
+		}
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+// Replay the journal into the store, dropping clients which expired while
+// the middleware was not running, then compact it
+func (f *fail2Ban) openJournal() {
+	records, corrupt, err := readJournal(f.journal.path, func(r journalRecord) {
+		if r.Op == journalUnban {
+			f.store.Unban(r.IP)
+		} else if r.Client != nil {
+			restored := r.Client.client()
+			f.store.Update(r.IP, true, func(c *client) bool {
+				*c = *restored
+				return true
+			})
+		}
+	})
+	f.store.Expire(time.Now(), f.banTime)
+	if err != nil {
+		f.logger.Errorf("Failed to read journal %q: %s", f.journal.path, err)
+	}
+	if corrupt != 0 {
+		f.logger.Warnf("Skipped %d corrupt records in journal %q", corrupt, f.journal.path)
+	}
+	f.logger.Infof("Replayed %d records from journal %q", records, f.journal.path)
+
+	// compacting also gets rid of corrupt records, which could otherwise
+	// run into the records appended after them
+	if err := f.compactJournal(); err != nil {
+		f.logger.Errorf("Failed to compact journal %q: %s", f.journal.path, err)
+	}
+}
+
+// Replace the journal with a record for each tracked client
+func (f *fail2Ban) compactJournal() error {
+	// changes wait for the new journal to be in place, so the ones made
+	// after the snapshot are appended to it rather than the old one
+	defer f.journal.clients.lockAll()()
+
+	var buff bytes.Buffer
+	var err error
+	now := time.Now()
+	clients := 0
+	f.store.Range(func(ip string, c client) bool {
+		state := newClientState(&c)
+		var line []byte
+		line, err = encodeJournalRecord(journalRecord{Op: journalClient, IP: ip, Time: now, Client: &state})
+		buff.Write(line)
+		clients++
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(f.journal.path, buff.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.journal.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	// records still buffered for the old journal are in the snapshot
+	f.journal.mu.Lock()
+	defer f.journal.mu.Unlock()
+	if f.journal.file != nil {
+		f.journal.file.Close()
+	}
+	f.journal.file = file
+	f.journal.writer = bufio.NewWriter(file)
+	f.journal.size = uint64(buff.Len())
+	f.logger.Debugf("Compacted journal %q to %d clients", f.journal.path, clients)
+	return nil
+}
+
+// Store which appends every change made to another store to the journal
+// before it is made
+type journalStore struct {
+	Store
+	journal *journal
+}
+
+func (s *journalStore) RecordFailure(ip string, now time.Time) (client, bool) {
+	defer s.journal.clients.lock(ip)()
+	c, ok := s.Store.Get(ip)
+	if ok {
+		c.lastViewed = now
+		c.failCounter++
+	} else {
+		// the first failure doesn't start the ban clock
+		c = client{failCounter: 1}
+	}
+	s.journal.append(journalCounter, ip, &c)
+	return s.Store.RecordFailure(ip, now)
+}
+
+func (s *journalStore) Ban(ip string, rule string, now time.Time) {
+	defer s.journal.clients.lock(ip)()
+	c, _ := s.Store.Get(ip)
+	c.banRule = rule
+	c.lastViewed = now
+	c.matched = append([]string(nil), c.matched...)
+	c.match(rule)
+	s.journal.append(journalBan, ip, &c)
+	s.Store.Ban(ip, rule, now)
+}
+
+func (s *journalStore) Unban(ip string) bool {
+	defer s.journal.clients.lock(ip)()
+	if _, ok := s.Store.Get(ip); !ok {
+		return false
+	}
+	s.journal.append(journalUnban, ip, nil)
+	return s.Store.Unban(ip)
+}
+
+// Only changes to the saved part of the client are journaled, so updates to
+// detector windows don't grow the journal. The record is appended before the
+// store lets go of the client, so no one sees the change before it is
+// journaled.
+func (s *journalStore) Update(ip string, create bool, fn func(c *client) bool) bool {
+	defer s.journal.clients.lock(ip)()
+	return s.Store.Update(ip, create, func(c *client) bool {
+		before := *c
+		kept := fn(c)
+		switch {
+		case !kept:
+			s.journal.append(journalUnban, ip, nil)
+		case len(before.banRule) == 0 && len(c.banRule) != 0:
+			s.journal.append(journalBan, ip, c)
+		case !newClientState(&before).equal(newClientState(c)):
+			s.journal.append(journalCounter, ip, c)
+		}
+		return kept
+	})
+}
+
+// Expired clients are journaled after they are forgotten, replaying the
+// journal forgets them again if the records are lost
+func (s *journalStore) Expire(now time.Time, banTime time.Duration) []string {
+	defer s.journal.clients.lockAll()()
+	expired := s.Store.Expire(now, banTime)
+	for _, ip := range expired {
+		s.journal.append(journalUnban, ip, nil)
+	}
+	return expired
+}
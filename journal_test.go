@@ -0,0 +1,184 @@
+package fail2ban
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newJournalTestServer(t *testing.T, ctx context.Context, file string, maxBytes uint64) *fail2Ban {
+	f := newTestServerContext(
+		t,
+		ctx,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 3,
+			Journal:     JournalConfig{File: file, MaxBytes: maxBytes},
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	return f
+}
+
+// Stop the middleware and wait for its journal to be closed
+func stopJournal(f *fail2Ban, cancel context.CancelFunc) {
+	cancel()
+	for idx := 0; idx < 100; idx++ {
+		f.journal.mu.Lock()
+		closed := f.journal.file == nil
+		f.journal.mu.Unlock()
+		if closed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal")
+	ctx, cancel := context.WithCancel(context.TODO())
+	f := newJournalTestServer(t, ctx, file, 0)
+	for idx := 0; idx < 3; idx++ {
+		f.incrementViewCounter("1.1.1.1")
+		f.incrementViewCounter("2.2.2.2")
+	}
+	memory(f).mu.Lock()
+	memory(f).clients["2.2.2.2"].lastViewed = time.Now().Add(-2 * time.Hour)
+	memory(f).mu.Unlock()
+	// expired bans get lifted when the client comes back
+	f.isClientBanned("2.2.2.2")
+	stopJournal(f, cancel)
+
+	ops := map[string]int{}
+	if _, corrupt, err := readJournal(file, func(r journalRecord) { ops[r.Op]++ }); err != nil || corrupt != 0 {
+		t.Fatalf("Failed to read journal, %d corrupt records, error %v", corrupt, err)
+	}
+	if ops[journalBan] != 2 || ops[journalUnban] != 1 || ops[journalCounter] != 6 {
+		t.Errorf("Unexpected journal records %v", ops)
+	}
+
+	restored := newJournalTestServer(t, context.TODO(), file, 0)
+	if info, ok := restored.inspectClient("1.1.1.1"); !ok || !info.Banned || info.FailCounter != 3 {
+		t.Errorf("Expected 1.1.1.1 to still be banned, got %+v", info)
+	}
+	if _, ok := restored.inspectClient("2.2.2.2"); ok {
+		t.Error("Unbanned client should not have been restored")
+	}
+}
+
+func TestJournalCorruptTail(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal")
+	var content []byte
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		line, _ := encodeJournalRecord(journalRecord{Op: journalBan, IP: ip, Time: time.Now(), Client: &clientState{LastViewed: time.Now(), FailCounter: 3}})
+		content = append(content, line...)
+	}
+	// a record with a bad checksum and one cut short by a crash
+	bad, _ := encodeJournalRecord(journalRecord{Op: journalUnban, IP: "1.1.1.1", Time: time.Now()})
+	bad[0] ^= 1
+	content = append(content, bad...)
+	cut, _ := encodeJournalRecord(journalRecord{Op: journalUnban, IP: "2.2.2.2", Time: time.Now()})
+	content = append(content, cut[:len(cut)/2]...)
+	os.WriteFile(file, content, 0o600)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	f := newJournalTestServer(t, ctx, file, 0)
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if info, ok := f.inspectClient(ip); !ok || !info.Banned {
+			t.Errorf("Expected %s to be banned, got %+v", ip, info)
+		}
+	}
+	f.incrementViewCounter("3.3.3.3")
+	stopJournal(f, cancel)
+
+	// the journal was compacted on startup so new records are readable
+	records, corrupt, err := readJournal(file, func(journalRecord) {})
+	if err != nil || corrupt != 0 || records != 3 {
+		t.Errorf("Expected 3 clean records, got %d records, %d corrupt, error %v", records, corrupt, err)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal")
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	f := newJournalTestServer(t, ctx, file, 2048)
+	f.incrementViewCounter("1.1.1.1")
+	for idx := 0; idx < 100; idx++ {
+		f.isClientBanned("1.1.1.1")
+		f.incrementViewCounter("2.2.2.2")
+	}
+
+	var size int64
+	for idx := 0; idx < 100; idx++ {
+		info, _ := os.Stat(file)
+		if size = info.Size(); size < 2048 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size >= 2048 {
+		t.Fatalf("Expected journal to be compacted, still %d bytes", size)
+	}
+	f.journal.mu.Lock()
+	defer f.journal.mu.Unlock()
+	content, _ := os.ReadFile(file)
+	if n := strings.Count(string(content), `"op":"client"`); n != 2 {
+		t.Errorf("Expected a client record for each client, got %d", n)
+	}
+}
+
+func TestJournalSync(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal")
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	f := newJournalTestServer(t, ctx, file, 0)
+
+	f.incrementViewCounter("1.2.3.4")
+	f.journal.sync()
+	records, _, err := readJournal(file, func(journalRecord) {})
+	if err != nil || records != 1 {
+		t.Errorf("Expected the record to be synced, got %d records and error %v", records, err)
+	}
+}
+
+func TestJournalAppendFailure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal")
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	f := newJournalTestServer(t, ctx, file, 0)
+	logs := &logBuffer{}
+	f.logger.SetOutput(logs)
+
+	// writes to a closed file fail
+	f.journal.mu.Lock()
+	f.journal.file.Close()
+	f.journal.mu.Unlock()
+	for idx := 0; idx < 5; idx++ {
+		f.incrementViewCounter("1.2.3.4")
+		f.journal.sync()
+	}
+	if n := strings.Count(logs.String(), "Failed to append to journal"); n != 1 {
+		t.Errorf("Expected the failure to be logged once but got %d times: %q", n, logs.String())
+	}
+}
+
+func TestJournalRecordChecksum(t *testing.T) {
+	line, err := encodeJournalRecord(journalRecord{Op: journalBan, IP: "1.2.3.4", Client: &clientState{FailCounter: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := decodeJournalRecord(line)
+	if err != nil || r.IP != "1.2.3.4" || r.Client.FailCounter != 3 {
+		t.Errorf("Failed to decode %q, got %+v and %v", line, r, err)
+	}
+	tampered := strings.Replace(string(line), `"failCounter":3`, `"failCounter":0`, 1)
+	if _, err := decodeJournalRecord([]byte(tampered)); err == nil {
+		t.Error("Expected tampered record to fail its checksum")
+	}
+}
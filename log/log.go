@@ -46,6 +46,12 @@ func New(prefix string, level LogLevel) *Logger {
 	}
 }
 
+func (l *Logger) SetOutput(output io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.output = output
+}
+
 func (l *Logger) message(level LogLevel, msg string) {
 	if level.toInt() < l.logLevel.toInt() {
 		return
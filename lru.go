@@ -0,0 +1,127 @@
+package fail2ban
+
+import (
+	"container/list"
+	"sort"
+
+	"github.com/rauny-henrique/fail2ban/log"
+)
+
+// Where a client is in the eviction order
+type lruEntry struct {
+	ip     string
+	banned bool
+}
+
+// Eviction order for a memory store with a cap on tracked clients. Clients
+// only counting failures are evicted least recently seen first, bans only
+// once there are no such clients left.
+type clientLRU struct {
+	max int
+	// least recently seen at the back
+	counters list.List
+	bans     list.List
+	elements map[string]*list.Element
+	// set while the cap is taken up by bans alone and new clients aren't tracked
+	shedding bool
+	stats    *stats
+	logger   *log.Logger
+}
+
+func (l *clientLRU) order(banned bool) *list.List {
+	if banned {
+		return &l.bans
+	}
+	return &l.counters
+}
+
+// Mark the client as just seen
+func (l *clientLRU) touch(ip string, c *client) {
+	banned := len(c.banRule) != 0
+	if e, ok := l.elements[ip]; ok {
+		entry := e.Value.(*lruEntry)
+		if entry.banned == banned {
+			l.order(banned).MoveToFront(e)
+			return
+		}
+		l.order(entry.banned).Remove(e)
+	}
+	l.elements[ip] = l.order(banned).PushFront(&lruEntry{ip: ip, banned: banned})
+}
+
+func (l *clientLRU) remove(ip string) {
+	if e, ok := l.elements[ip]; ok {
+		l.order(e.Value.(*lruEntry).banned).Remove(e)
+		delete(l.elements, ip)
+	}
+}
+
+// Evict the least recently seen client of an order, returning its IP
+func (l *clientLRU) evict(order *list.List) string {
+	e := order.Back()
+	ip := e.Value.(*lruEntry).ip
+	order.Remove(e)
+	delete(l.elements, ip)
+	if order == &l.bans {
+		l.stats.record(eventEvictedBan)
+	} else {
+		l.stats.record(eventEvicted)
+	}
+	return ip
+}
+
+// Make room for a new client, returning the IP evicted for it. Clients
+// which are getting banned may evict a ban, others are shed when only
+// bans are left.
+func (l *clientLRU) admit(tracked int, ban bool) (evicted string, ok bool) {
+	if tracked < l.max {
+		if l.shedding {
+			l.logger.Infof("Tracking %d clients, below MaxTrackedClients again", tracked)
+			l.shedding = false
+		}
+		return "", true
+	}
+	if l.counters.Len() != 0 {
+		return l.evict(&l.counters), true
+	}
+	if !l.shedding {
+		l.logger.Warnf("All %d tracked clients are banned, new clients aren't tracked until bans expire", tracked)
+		l.shedding = true
+	}
+	if ban && l.bans.Len() != 0 {
+		return l.evict(&l.bans), true
+	}
+	l.stats.record(eventShed)
+	return "", false
+}
+
+// Cap the number of tracked clients at max, 0 takes the cap off. Clients
+// already tracked are ordered by when they were last seen and evicted down
+// to the cap.
+func (s *memoryStore) limit(max int, st *stats, logger *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max == 0 {
+		s.lru = nil
+		return
+	}
+	l := &clientLRU{max: max, elements: make(map[string]*list.Element), stats: st, logger: logger}
+	ips := make([]string, 0, len(s.clients))
+	for ip := range s.clients {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return s.clients[ips[i]].lastViewed.Before(s.clients[ips[j]].lastViewed)
+	})
+	for _, ip := range ips {
+		l.touch(ip, s.clients[ip])
+	}
+	for len(s.clients) > max {
+		order := &l.counters
+		if order.Len() == 0 {
+			order = &l.bans
+		}
+		delete(s.clients, l.evict(order))
+	}
+	s.lru = l
+}
@@ -0,0 +1,126 @@
+package fail2ban
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rauny-henrique/fail2ban/log"
+)
+
+func newLimitedStore(max int) (*memoryStore, *stats) {
+	s, st := newMemoryStore(), newStats()
+	s.limit(max, st, log.New("test", log.Error))
+	return s, st
+}
+
+func TestLRUEvictsCountersFirst(t *testing.T) {
+	s, st := newLimitedStore(3)
+	now := time.Now()
+	s.Ban("1.1.1.1", ruleScanner, now)
+	s.RecordFailure("2.2.2.2", now)
+	s.RecordFailure("3.3.3.3", now)
+	// seeing 2.2.2.2 again leaves 3.3.3.3 as the least recently seen
+	s.Get("2.2.2.2")
+
+	s.RecordFailure("4.4.4.4", now)
+	if _, ok := s.Get("3.3.3.3"); ok {
+		t.Error("Least recently seen client should have been evicted")
+	}
+	s.Update("5.5.5.5", true, func(c *client) bool { return true })
+	if _, ok := s.Get("2.2.2.2"); ok {
+		t.Error("Next least recently seen client should have been evicted")
+	}
+	if _, ok := s.Get("1.1.1.1"); !ok {
+		t.Error("Ban should not have been evicted before clients only counting failures")
+	}
+	if s.Len() != 3 || st.events[eventEvicted] != 2 {
+		t.Errorf("Expected 3 clients and 2 evictions but got %d and %d", s.Len(), st.events[eventEvicted])
+	}
+}
+
+func TestLRUShedding(t *testing.T) {
+	s, st := newLimitedStore(2)
+	now := time.Now()
+	s.Ban("1.1.1.1", ruleScanner, now)
+	s.Ban("2.2.2.2", ruleScanner, now)
+	s.Get("1.1.1.1")
+
+	// only bans are left, new clients aren't tracked
+	if _, created := s.RecordFailure("3.3.3.3", now); !created {
+		t.Error("Shed client should look like a first failure")
+	}
+	if s.Update("4.4.4.4", true, func(c *client) bool { return true }) {
+		t.Error("Shed client should not have been created")
+	}
+	if s.Len() != 2 || st.events[eventShed] != 2 {
+		t.Errorf("Expected 2 clients and 2 shed but got %d and %d", s.Len(), st.events[eventShed])
+	}
+
+	// a new ban replaces the least recently seen one
+	s.Ban("5.5.5.5", ruleBandwidth, now)
+	if _, ok := s.Get("2.2.2.2"); ok {
+		t.Error("Least recently seen ban should have been evicted")
+	}
+	if _, ok := s.Get("5.5.5.5"); !ok || st.events[eventEvictedBan] != 1 {
+		t.Error("New ban should have been tracked")
+	}
+
+	// leaving room stops shedding
+	s.Unban("1.1.1.1")
+	if _, created := s.RecordFailure("3.3.3.3", now); !created || s.Len() != 2 {
+		t.Error("Client should have been tracked once there was room")
+	}
+}
+
+func TestLRULimitExisting(t *testing.T) {
+	s := newMemoryStore()
+	now := time.Now()
+	s.Ban("1.1.1.1", ruleScanner, now.Add(-time.Hour))
+	s.Update("2.2.2.2", true, func(c *client) bool {
+		c.lastViewed = now.Add(-time.Minute)
+		return true
+	})
+	s.Update("3.3.3.3", true, func(c *client) bool { return true })
+	s.limit(2, newStats(), log.New("test", log.Error))
+
+	if _, ok := s.Get("2.2.2.2"); ok || s.Len() != 2 {
+		t.Error("Least recently seen client should have been evicted down to the cap")
+	}
+	if _, ok := s.Get("1.1.1.1"); !ok {
+		t.Error("Ban should have been kept")
+	}
+	s.limit(0, nil, nil)
+	s.RecordFailure("4.4.4.4", now)
+	if s.Len() != 3 {
+		t.Error("Taking the cap off should track every client")
+	}
+}
+
+func TestMaxTrackedClientsConfig(t *testing.T) {
+	tests := map[string]struct {
+		max int
+		err bool
+	}{
+		"no cap":   {max: 0},
+		"capped":   {max: 100},
+		"negative": {max: -1, err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			config := CreateConfig()
+			config.LogLevel = "ERROR"
+			config.MaxTrackedClients = test.max
+			h, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, uniqueName())
+			if (err != nil) != test.err {
+				t.Fatalf("Expected error %t but got %v", test.err, err)
+			}
+			if err == nil && (memory(h.(*fail2Ban)).lru != nil) != (test.max != 0) {
+				t.Errorf("Expected a cap of %d", test.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package fail2ban
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	modeEnforce = "enforce"
+	modeMonitor = "monitor"
+)
+
+// Parse a rule's mode, an empty mode uses fallback
+func parseMode(mode string, fallback string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return fallback, nil
+	case modeEnforce:
+		return modeEnforce, nil
+	case modeMonitor:
+		return modeMonitor, nil
+	default:
+		return "", fmt.Errorf("invalid mode %q", mode)
+	}
+}
+
+// Work out which rules are only monitored, rules without their own mode use
+// the top level one
+func newMonitoredRules(config *Config) (map[string]bool, error) {
+	global, err := parseMode(config.Mode, modeEnforce)
+	if err != nil {
+		return nil, err
+	}
+	monitor := map[string]bool{ruleFails: global == modeMonitor}
+	for rule, mode := range map[string]string{
+		ruleBandwidth:   config.Bandwidth.Mode,
+		ruleScanner:     config.Scanner.Mode,
+		ruleEnumeration: config.Enumeration.Mode,
+	} {
+		parsed, err := parseMode(mode, global)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule, err)
+		}
+		monitor[rule] = parsed == modeMonitor
+	}
+	return monitor, nil
+}
+
+// Names of the monitored rules, sorted for logging
+func monitoredRuleNames(monitor map[string]bool) []string {
+	var names []string
+	for rule, monitored := range monitor {
+		if monitored {
+			names = append(names, rule)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Log and count a ban a monitored rule would have made
+func (f *fail2Ban) wouldBan(ip string, rule string, reason string) {
+	f.logger.Infof("Would ban %s %s, %q is in monitor mode", ip, reason, rule)
+	f.stats.record(eventWouldBan)
+}
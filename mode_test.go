@@ -0,0 +1,154 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newModeTestServer(t *testing.T, config *Config) *fail2Ban {
+	config.BanTime = "1h"
+	config.LogLevel = "ERROR"
+	f := newTestServer(
+		t,
+		config,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		}),
+	)
+	return f
+}
+
+func serveMode(f *fail2Ban, client string, path string) int {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://garbage"+path, nil)
+	request.RemoteAddr = client + ":5678"
+	f.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestMonitorMode(t *testing.T) {
+	f := newModeTestServer(t, &Config{
+		NumberFails: 3,
+		Mode:        "monitor",
+		Throttle:    ThrottleConfig{RejectAfter: 1},
+	})
+
+	for idx := 0; idx < 10; idx++ {
+		if code := serveMode(f, "1.2.3.4", "/missing"); code != http.StatusNotFound {
+			t.Errorf("Expected request %d to be forwarded but got %d", idx, code)
+		}
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); info.Banned {
+		t.Errorf("Client should not be banned, got %+v", info)
+	}
+	stats := f.snapshotStats()
+	if stats.Events[eventWouldBan] != 3 || stats.Events[eventBan] != 0 || stats.Events[eventReject] != 0 {
+		t.Errorf("Expected 3 would be bans and no bans or rejects, got %v", stats.Events)
+	}
+}
+
+func TestMonitorModePerRule(t *testing.T) {
+	tests := map[string]struct {
+		config    *Config
+		banned    bool
+		rule      string
+		wouldBans uint64
+		forwarded int
+	}{
+		"scanner monitored": {
+			config: &Config{
+				NumberFails: 8,
+				Scanner:     ScannerConfig{MaxDistinctPaths: 3, Mode: "monitor"},
+			},
+			banned:    true,
+			rule:      ruleFails,
+			wouldBans: 2,
+			forwarded: 8,
+		},
+		"scanner enforced": {
+			config: &Config{
+				NumberFails: 8,
+				Mode:        "monitor",
+				Scanner:     ScannerConfig{MaxDistinctPaths: 3, Mode: "enforce"},
+			},
+			banned:    true,
+			rule:      ruleScanner,
+			wouldBans: 0,
+			forwarded: 3,
+		},
+		"enumeration monitored": {
+			config: &Config{
+				NumberFails: 100,
+				Enumeration: EnumerationConfig{MaxDistinctIDs: 4, Mode: "monitor"},
+			},
+			wouldBans: 2,
+			forwarded: 10,
+		},
+		"bandwidth monitored": {
+			config: &Config{
+				NumberFails: 100,
+				Bandwidth:   BandwidthConfig{MaxBytes: 20, Action: "ban", Mode: "monitor"},
+			},
+			wouldBans: 3,
+			forwarded: 10,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := newModeTestServer(t, test.config)
+			forwarded := 0
+			for idx := 0; idx < 10; idx++ {
+				if serveMode(f, "1.2.3.4", fmt.Sprintf("/api/orders/%d", idx)) == http.StatusNotFound {
+					forwarded++
+				}
+			}
+			if forwarded != test.forwarded {
+				t.Errorf("Expected %d requests to be forwarded but got %d", test.forwarded, forwarded)
+			}
+			info, _ := f.inspectClient("1.2.3.4")
+			if info.Banned != test.banned || (test.banned && info.BanRule != test.rule) {
+				t.Errorf("Expected banned %t by %q, got %+v", test.banned, test.rule, info)
+			}
+			if n := f.snapshotStats().Events[eventWouldBan]; n != test.wouldBans {
+				t.Errorf("Expected %d would be bans but got %d", test.wouldBans, n)
+			}
+		})
+	}
+}
+
+func TestMonitorBandwidthThrottle(t *testing.T) {
+	f := newModeTestServer(t, &Config{
+		NumberFails: 100,
+		Bandwidth:   BandwidthConfig{MaxBytes: 20, Window: "1h", Mode: "monitor"},
+	})
+	for idx := 0; idx < 6; idx++ {
+		if code := serveMode(f, "1.2.3.4", "/"); code != http.StatusNotFound {
+			t.Errorf("Expected request %d to be forwarded but got %d", idx, code)
+		}
+	}
+	if events := f.snapshotStats().Events; events[eventWouldThrottle] != 2 || events[eventThrottle] != 0 {
+		t.Errorf("Expected 2 would be throttles and no throttles, got %v", events)
+	}
+}
+
+func TestModeConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  Config
+		isError bool
+	}{
+		"default":          {Config{}, false},
+		"monitor":          {Config{Mode: "Monitor"}, false},
+		"bad mode":         {Config{Mode: "garbage"}, true},
+		"bad scanner mode": {Config{Scanner: ScannerConfig{Mode: "garbage"}}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newMonitoredRules(&test.config); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
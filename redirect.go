@@ -0,0 +1,181 @@
+package fail2ban
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// RedirectConfig sends banned clients to a page explaining they are blocked
+type RedirectConfig struct {
+	// URL is a Go template, with the fields of redirectTemplateData available
+	URL string
+	// StatusCode is either 302 or 307
+	StatusCode int
+	// Secret used to sign the reference token, a random one is used if not set
+	Secret string
+}
+
+// Data available to the redirect URL template, the ban details are query
+// escaped as the client IP may come from ClientHeader
+type redirectTemplateData struct {
+	banDetails
+	// Token is a signed version of the ban details support can verify
+	Token string
+}
+
+// contents of the signed reference token
+type banToken struct {
+	IP        string `json:"ip"`
+	Reason    string `json:"reason"`
+	Expires   int64  `json:"exp"`
+	Reference string `json:"ref"`
+}
+
+type redirect struct {
+	url        *template.Template
+	statusCode int
+	signer     *signer
+	// where banned clients get redirected to, requests for it are let through.
+	// A path with template actions matches on its static part before them.
+	targetHost   string
+	targetPath   string
+	targetPrefix bool
+}
+
+func newRedirect(config RedirectConfig) (*redirect, error) {
+	r := &redirect{statusCode: http.StatusFound}
+	switch config.StatusCode {
+	case 0:
+	case http.StatusFound, http.StatusTemporaryRedirect:
+		r.statusCode = config.StatusCode
+	default:
+		return nil, fmt.Errorf("invalid redirect status code %d, must be 302 or 307", config.StatusCode)
+	}
+	if len(config.URL) == 0 {
+		return nil, fmt.Errorf("redirect URL must be set to redirect banned clients")
+	}
+
+	var err error
+	if r.url, err = template.New("redirect").Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("invalid redirect URL: %w", err)
+	}
+	var buff bytes.Buffer
+	if err := r.url.Execute(&buff, redirectTemplateData{}); err != nil {
+		return nil, fmt.Errorf("invalid redirect URL: %w", err)
+	}
+	if _, err := url.Parse(buff.String()); err != nil {
+		return nil, fmt.Errorf("invalid redirect URL: %w", err)
+	}
+	static := config.URL
+	if idx := strings.Index(static, "{{"); idx >= 0 {
+		static = static[:idx]
+		r.targetPrefix = !strings.ContainsAny(static, "?#")
+	}
+	target, err := url.Parse(static)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect URL: %w", err)
+	}
+	r.targetHost = target.Host
+	r.targetPath = target.Path
+	if r.targetPrefix && (len(r.targetPath) == 0 || len(r.targetHost) == 0 && r.targetPath == "/") {
+		return nil, fmt.Errorf("redirect URL needs a static path before its first template action")
+	}
+	if len(r.targetPath) == 0 {
+		r.targetPath = "/"
+	}
+
+	if r.signer, err = newSigner(config.Secret); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Check if the request is for the redirect target, so redirected clients
+// can load it without looping back into another redirect
+func (r *redirect) isTarget(req *http.Request) bool {
+	if len(r.targetHost) != 0 && !strings.EqualFold(r.targetHost, req.Host) {
+		return false
+	}
+	if r.targetPrefix {
+		return strings.HasPrefix(req.URL.Path, r.targetPath)
+	}
+	return req.URL.Path == r.targetPath
+}
+
+func (r *redirect) token(ban banDetails) string {
+	payload, _ := json.Marshal(banToken{
+		IP:        ban.IP,
+		Reason:    ban.Reason,
+		Expires:   ban.Expires.Unix(),
+		Reference: ban.Reference,
+	})
+	return r.signer.sign(payload)
+}
+
+// Check the token was issued by this middleware and return the ban it was issued for
+func (r *redirect) verifyToken(token string) (banDetails, bool) {
+	payload, ok := r.signer.verify(token)
+	if !ok {
+		return banDetails{}, false
+	}
+	var t banToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return banDetails{}, false
+	}
+	return banDetails{
+		IP:        t.IP,
+		Reason:    t.Reason,
+		Expires:   time.Unix(t.Expires, 0),
+		Reference: t.Reference,
+	}, true
+}
+
+// What support gets when looking up a reference token
+type tokenLookup struct {
+	Ban banDetails `json:"ban"`
+	// current state of the client, if it is still tracked
+	Client *clientInfo `json:"client,omitempty"`
+}
+
+// Verify a reference token and look up the client it was issued for
+func (f *fail2Ban) lookupToken(token string) (tokenLookup, bool) {
+	if f.redirect == nil {
+		return tokenLookup{}, false
+	}
+	ban, ok := f.redirect.verifyToken(token)
+	if !ok {
+		return tokenLookup{}, false
+	}
+	lookup := tokenLookup{Ban: ban}
+	if info, ok := f.inspectClient(ban.IP); ok {
+		lookup.Client = &info
+	}
+	return lookup, true
+}
+
+func (r *redirect) write(rw http.ResponseWriter, ban banDetails) error {
+	var buff bytes.Buffer
+	err := r.url.Execute(&buff, redirectTemplateData{
+		banDetails: banDetails{
+			IP:        url.QueryEscape(ban.IP),
+			Reason:    url.QueryEscape(ban.Reason),
+			Expires:   ban.Expires,
+			Reference: url.QueryEscape(ban.Reference),
+		},
+		Token: r.token(ban),
+	})
+	if err != nil {
+		rw.WriteHeader(http.StatusForbidden)
+		return err
+	}
+	rw.Header().Set("Location", buff.String())
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(r.statusCode)
+	return nil
+}
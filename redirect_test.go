@@ -0,0 +1,235 @@
+package fail2ban
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newRedirectTestServer(t *testing.T, config RedirectConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 2,
+			BanAction:   "redirect",
+			Redirect:    config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	return f
+}
+
+func serveRedirect(f *fail2Ban, target string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", target, nil)
+	request.RemoteAddr = "1.2.3.4:5678"
+	f.ServeHTTP(response, request)
+	return response
+}
+
+func TestRedirectBanned(t *testing.T) {
+	f := newRedirectTestServer(t, RedirectConfig{
+		URL:        "https://blocked.example.com/?ref={{.Token}}",
+		StatusCode: http.StatusTemporaryRedirect,
+		Secret:     "secret",
+	})
+
+	for idx := 0; idx < 2; idx++ {
+		serveRedirect(f, "http://example.com/missing")
+	}
+	response := serveRedirect(f, "http://example.com/missing")
+	if response.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected response to be %d but got %d", http.StatusTemporaryRedirect, response.Code)
+	}
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil || location.Host != "blocked.example.com" {
+		t.Fatalf("Unexpected location %q", response.Header().Get("Location"))
+	}
+
+	ban, ok := f.redirect.verifyToken(location.Query().Get("ref"))
+	if !ok {
+		t.Fatal("Reference token should verify")
+	}
+	info, _ := f.inspectClient("1.2.3.4")
+	if ban.IP != "1.2.3.4" || ban.Reason != ruleFails || ban.Reference != info.BanReference {
+		t.Errorf("Unexpected ban in token %+v", ban)
+	}
+	if _, ok := f.redirect.verifyToken(location.Query().Get("ref") + "garbage"); ok {
+		t.Error("Tampered token should not verify")
+	}
+}
+
+func TestRedirectTargetNotCounted(t *testing.T) {
+	f := newRedirectTestServer(t, RedirectConfig{
+		URL: "/blocked?ip={{.IP}}",
+	})
+
+	// the target itself 404s, it should never count or get redirected
+	for idx := 0; idx < 5; idx++ {
+		if response := serveRedirect(f, "http://example.com/blocked"); response.Code != http.StatusNotFound {
+			t.Errorf("Expected target to be served, got %d", response.Code)
+		}
+	}
+	if _, ok := f.inspectClient("1.2.3.4"); ok {
+		t.Error("Requests for the redirect target should not be counted")
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		serveRedirect(f, "http://example.com/missing")
+	}
+	response := serveRedirect(f, "http://example.com/missing")
+	if response.Code != http.StatusFound || response.Header().Get("Location") != "/blocked?ip=1.2.3.4" {
+		t.Errorf("Expected redirect to target, got %d %q", response.Code, response.Header().Get("Location"))
+	}
+	if response := serveRedirect(f, "http://example.com/blocked"); response.Code != http.StatusNotFound {
+		t.Errorf("Banned client should still get the target, got %d", response.Code)
+	}
+}
+
+func TestRedirectEscapesClient(t *testing.T) {
+	f := newTestServer(t, &Config{
+		BanTime:      "1h",
+		LogLevel:     "ERROR",
+		NumberFails:  2,
+		ClientHeader: "client",
+		BanAction:    "redirect",
+		Redirect:     RedirectConfig{URL: "/blocked?ip={{.IP}}&ref={{.Reference}}"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	var response *httptest.ResponseRecorder
+	for idx := 0; idx < 3; idx++ {
+		response = httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://example.com/missing", nil)
+		request.Header.Set("client", "1.2.3.4&admin=1")
+		f.ServeHTTP(response, request)
+	}
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Unexpected location %q", response.Header().Get("Location"))
+	}
+	if query := location.Query(); query.Get("ip") != "1.2.3.4&admin=1" || query.Has("admin") {
+		t.Errorf("Expected the client to be escaped, got %q", location)
+	}
+}
+
+func TestRedirectTokenLookup(t *testing.T) {
+	f := newTestServer(t, &Config{
+		BanTime:     "1h",
+		LogLevel:    "ERROR",
+		NumberFails: 2,
+		BanAction:   "redirect",
+		Redirect:    RedirectConfig{URL: "https://blocked.example.com/?ref={{.Token}}"},
+		Stats:       StatsConfig{Path: "/.fail2ban/stats", Token: "secret"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	for idx := 0; idx < 2; idx++ {
+		serveRedirect(f, "http://example.com/missing")
+	}
+	location, _ := url.Parse(serveRedirect(f, "http://example.com/missing").Header().Get("Location"))
+	token := location.Query().Get("ref")
+
+	tests := map[string]struct {
+		token string
+		code  int
+	}{
+		"Should look up a valid token":     {token: token, code: http.StatusOK},
+		"Should not find a tampered token": {token: token + "garbage", code: http.StatusNotFound},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "http://example.com/.fail2ban/stats?token="+url.QueryEscape(test.token), nil)
+			request.Header.Set("Authorization", "Bearer secret")
+			f.ServeHTTP(response, request)
+			if response.Code != test.code {
+				t.Fatalf("Expected response to be %d but got %d", test.code, response.Code)
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			var lookup tokenLookup
+			if err := json.NewDecoder(response.Body).Decode(&lookup); err != nil {
+				t.Fatalf("Expected lookup to be JSON but got %v", err)
+			}
+			if lookup.Ban.IP != "1.2.3.4" || lookup.Client == nil || !lookup.Client.Banned || lookup.Client.BanReference != lookup.Ban.Reference {
+				t.Errorf("Unexpected lookup %+v", lookup)
+			}
+		})
+	}
+}
+
+func TestRedirectIsTarget(t *testing.T) {
+	r, err := newRedirect(RedirectConfig{URL: "https://blocked.example.com/sorry?ref={{.Token}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"https://blocked.example.com/sorry":       true,
+		"https://blocked.example.com/sorry?x=1":   true,
+		"https://BLOCKED.example.com/sorry":       true,
+		"https://blocked.example.com/other":       false,
+		"https://www.example.com/sorry":           false,
+		"https://blocked.example.com/sorry/again": false,
+	}
+	for target, expected := range tests {
+		if r.isTarget(httptest.NewRequest("GET", target, nil)) != expected {
+			t.Errorf("Expected %q target to be %t", target, expected)
+		}
+	}
+}
+
+func TestRedirectIsTargetPrefix(t *testing.T) {
+	r, err := newRedirect(RedirectConfig{URL: "/blocked/{{.Reference}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"https://www.example.com/blocked/abc123": true,
+		"https://www.example.com/blocked/":       true,
+		"https://www.example.com/blocked":        false,
+		"https://www.example.com/other/abc123":   false,
+	}
+	for target, expected := range tests {
+		if r.isTarget(httptest.NewRequest("GET", target, nil)) != expected {
+			t.Errorf("Expected %q target to be %t", target, expected)
+		}
+	}
+}
+
+func TestRedirectConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  RedirectConfig
+		isError bool
+	}{
+		"valid":         {RedirectConfig{URL: "/blocked"}, false},
+		"307":           {RedirectConfig{URL: "/blocked", StatusCode: 307}, false},
+		"no url":        {RedirectConfig{}, true},
+		"bad status":    {RedirectConfig{URL: "/blocked", StatusCode: 301}, true},
+		"bad template":  {RedirectConfig{URL: "/blocked?{{.Token"}, true},
+		"unknown field": {RedirectConfig{URL: "/blocked?{{.Garbage}}"}, true},
+		"bad url":       {RedirectConfig{URL: "http://[::1"}, true},
+		"path action":   {RedirectConfig{URL: "/blocked/{{.Reference}}"}, false},
+		"root action":   {RedirectConfig{URL: "/{{.Reference}}"}, true},
+		"host action":   {RedirectConfig{URL: "https://{{.Reference}}.example.com/"}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newRedirect(test.config); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+	if _, err := parseBanAction("garbage"); err == nil {
+		t.Error("Expected error for unknown ban action")
+	}
+}
@@ -0,0 +1,329 @@
+package fail2ban
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rauny-henrique/fail2ban/log"
+)
+
+const (
+	redisFailOpen   = "open"
+	redisFailClosed = "closed"
+
+	// rule blocking every client while Redis is down in fail closed mode
+	ruleUnavailable = "unavailable"
+
+	// how long to wait before talking to Redis again after it failed
+	redisRetryInterval = time.Second
+)
+
+var errRedisUnavailable = errors.New("redis is unavailable")
+
+// RedisConfig shares fail counters and bans between instances through Redis
+type RedisConfig struct {
+	// Address of the Redis server, eg "localhost:6379". Empty keeps all
+	// state in memory.
+	Address  string
+	Username string
+	Password string
+	DB       int
+	// KeyPrefix of every key written
+	KeyPrefix string
+	// Timeout for connecting to and talking to Redis
+	Timeout string
+	// CacheTTL is how long fail counters and bans read from Redis are
+	// cached for, 0 reads them on every request
+	CacheTTL string
+	// FailMode is "open" to carry on with the local state when Redis is
+	// down, or "closed" to block every request
+	FailMode string
+}
+
+// Store keeping fail counters and bans in Redis so every instance sees
+// them. Detector windows stay local, along with a cached copy of the
+// counters and bans. Only clients Redis knows about are cached, so the
+// cache is bounded like any other tracked client.
+type redisStore struct {
+	client     *respClient
+	prefix     string
+	banTime    time.Duration
+	cacheTTL   time.Duration
+	failClosed bool
+	logger     *log.Logger
+	local      *memoryStore
+
+	// mutex protects the fields below
+	mu sync.Mutex
+	// set while Redis is down, no requests are made to it until retryAt
+	down    bool
+	retryAt time.Time
+}
+
+func newRedisStore(config RedisConfig, banTime time.Duration) (*redisStore, error) {
+	if len(config.Address) == 0 {
+		return nil, nil
+	}
+	s := &redisStore{
+		prefix:   config.KeyPrefix,
+		banTime:  banTime,
+		cacheTTL: time.Second,
+		local:    newMemoryStore(),
+	}
+	if len(s.prefix) == 0 {
+		s.prefix = "fail2ban:"
+	}
+	switch strings.ToLower(config.FailMode) {
+	case "", redisFailOpen:
+	case redisFailClosed:
+		s.failClosed = true
+	default:
+		return nil, fmt.Errorf("invalid redis fail mode %q", config.FailMode)
+	}
+	timeout := time.Second
+	err := parseDurations("redis",
+		durationOption{"timeout", config.Timeout, &timeout},
+		durationOption{"cache TTL", config.CacheTTL, &s.cacheTTL},
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.client = newRESPClient(config.Address, config.Username, config.Password, config.DB, timeout)
+	return s, nil
+}
+
+func (s *redisStore) failsKey(ip string) string {
+	return s.prefix + "fails:" + ip
+}
+
+func (s *redisStore) banKey(ip string) string {
+	return s.prefix + "ban:" + ip
+}
+
+// Send commands to Redis unless it is known to be down
+func (s *redisStore) pipeline(cmds ...[]string) ([]any, error) {
+	s.mu.Lock()
+	if s.down && time.Now().Before(s.retryAt) {
+		s.mu.Unlock()
+		return nil, errRedisUnavailable
+	}
+	s.mu.Unlock()
+
+	replies, err := s.client.pipeline(cmds...)
+	if err == nil {
+		for _, reply := range replies {
+			if respErr, ok := reply.(respError); ok {
+				err = respErr
+				break
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if !s.down {
+			s.logger.Errorf("Redis store is unavailable, failing %s: %s", s.failMode(), err)
+		}
+		s.down = true
+		s.retryAt = time.Now().Add(redisRetryInterval)
+		return nil, err
+	}
+	if s.down {
+		s.logger.Info("Redis store is available again")
+		s.down = false
+	}
+	return replies, nil
+}
+
+func (s *redisStore) failMode() string {
+	if s.failClosed {
+		return redisFailClosed
+	}
+	return redisFailOpen
+}
+
+// Client blocked while Redis is down in fail closed mode, every client gets
+// the same reference
+func (s *redisStore) unavailable() client {
+	return client{lastViewed: time.Now(), banRule: ruleUnavailable, banRef: ruleUnavailable}
+}
+
+// Read the client's fail counter and ban from Redis into the local copy,
+// unless it was read within the cache TTL
+func (s *redisStore) refresh(ip string) error {
+	now := time.Now()
+	if c, ok := s.local.Get(ip); ok && now.Sub(c.fetched) < s.cacheTTL {
+		return nil
+	}
+
+	failsKey, banKey := s.failsKey(ip), s.banKey(ip)
+	replies, err := s.pipeline(
+		[]string{"GET", failsKey},
+		[]string{"PTTL", failsKey},
+		[]string{"GET", banKey},
+		[]string{"PTTL", banKey},
+	)
+	if err != nil {
+		return err
+	}
+	failCounter, err := respInt(replies[0])
+	if err != nil {
+		return err
+	}
+	ban, err := respString(replies[2])
+	if err != nil {
+		return err
+	}
+	rule, ref, _ := strings.Cut(ban, " ")
+	// keys expire banTime after the client was last seen, work out when that was
+	var lastViewed time.Time
+	for _, reply := range []any{replies[1], replies[3]} {
+		if ttl, err := respInt(reply); err == nil && ttl > 0 {
+			if seen := now.Add(time.Duration(ttl)*time.Millisecond - s.banTime); seen.After(lastViewed) {
+				lastViewed = seen
+			}
+		}
+	}
+
+	exists := failCounter > 0 || len(rule) != 0
+	s.local.Update(ip, exists, func(c *client) bool {
+		// another instance may have lifted the ban, the detector windows are kept
+		c.failCounter = uint(failCounter)
+		c.banRule = rule
+		c.banRef = ref
+		if lastViewed.After(c.lastViewed) {
+			c.lastViewed = lastViewed
+		}
+		if len(rule) != 0 {
+			c.match(rule)
+		}
+		c.fetched = now
+		return true
+	})
+	return nil
+}
+
+// Write changes to the client's fail counter and ban to Redis
+func (s *redisStore) push(ip string, before client, after client) {
+	ttl := s.banTime
+	if !after.lastViewed.IsZero() {
+		ttl -= time.Since(after.lastViewed)
+	}
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	px := strconv.FormatInt(ttl.Milliseconds(), 10)
+
+	var cmds [][]string
+	if after.failCounter != before.failCounter {
+		if after.failCounter == 0 {
+			cmds = append(cmds, []string{"DEL", s.failsKey(ip)})
+		} else {
+			cmds = append(cmds, []string{"SET", s.failsKey(ip), strconv.FormatUint(uint64(after.failCounter), 10), "PX", px})
+		}
+	}
+	if after.banRule != before.banRule || after.banRef != before.banRef || (len(after.banRule) != 0 && !after.lastViewed.Equal(before.lastViewed)) {
+		if len(after.banRule) == 0 {
+			cmds = append(cmds, []string{"DEL", s.banKey(ip)})
+		} else {
+			cmds = append(cmds, []string{"SET", s.banKey(ip), strings.TrimSpace(after.banRule + " " + after.banRef), "PX", px})
+		}
+	}
+	if len(cmds) != 0 {
+		s.pipeline(cmds...)
+	}
+}
+
+func (s *redisStore) Get(ip string) (client, bool) {
+	if err := s.refresh(ip); err != nil && s.failClosed {
+		return s.unavailable(), true
+	}
+	return s.local.Get(ip)
+}
+
+func (s *redisStore) RecordFailure(ip string, now time.Time) (client, bool) {
+	failsKey := s.failsKey(ip)
+	replies, err := s.pipeline(
+		[]string{"INCR", failsKey},
+		[]string{"PEXPIRE", failsKey, strconv.FormatInt(s.banTime.Milliseconds(), 10)},
+	)
+	if err != nil {
+		// keep counting locally so the client can still get banned
+		return s.local.RecordFailure(ip, now)
+	}
+	count, _ := respInt(replies[0])
+	var c client
+	s.local.Update(ip, true, func(lc *client) bool {
+		lc.failCounter = uint(count)
+		lc.lastViewed = now
+		c = *lc
+		return true
+	})
+	return c, count == 1
+}
+
+func (s *redisStore) Ban(ip string, rule string, now time.Time) {
+	var before client
+	s.local.Update(ip, true, func(c *client) bool {
+		before = *c
+		return true
+	})
+	s.local.Ban(ip, rule, now)
+	after, _ := s.local.Get(ip)
+	s.push(ip, before, after)
+}
+
+func (s *redisStore) Unban(ip string) bool {
+	replies, err := s.pipeline([]string{"DEL", s.failsKey(ip), s.banKey(ip)})
+	ok := s.local.Unban(ip)
+	if err == nil {
+		if n, _ := respInt(replies[0]); n > 0 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (s *redisStore) Update(ip string, create bool, fn func(c *client) bool) bool {
+	if err := s.refresh(ip); err != nil && s.failClosed {
+		c := s.unavailable()
+		fn(&c)
+		return true
+	}
+	var before, after client
+	kept := true
+	ok := s.local.Update(ip, create, func(c *client) bool {
+		before = *c
+		kept = fn(c)
+		after = *c
+		return kept
+	})
+	if !ok {
+		return false
+	}
+	if !kept {
+		s.Unban(ip)
+		return true
+	}
+	s.push(ip, before, after)
+	return true
+}
+
+// Only clients this instance has seen
+func (s *redisStore) Range(fn func(ip string, c client) bool) {
+	s.local.Range(fn)
+}
+
+// Redis expires its keys by itself, only the local copies need forgetting
+func (s *redisStore) Expire(now time.Time, banTime time.Duration) []string {
+	return s.local.Expire(now, banTime)
+}
+
+func (s *redisStore) Len() int {
+	return s.local.Len()
+}
@@ -0,0 +1,381 @@
+package fail2ban
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rauny-henrique/fail2ban/log"
+)
+
+type redisStubEntry struct {
+	value   string
+	expires time.Time
+}
+
+// Just enough of a Redis server for the store
+type redisStub struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	keys     map[string]*redisStubEntry
+}
+
+func newRedisStub(t *testing.T, password string) *redisStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s := &redisStub{listener: listener, password: password, keys: make(map[string]*redisStubEntry)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *redisStub) address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *redisStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := len(s.password) == 0
+	for {
+		cmd, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := cmd.([]any)
+		args := make([]string, len(items))
+		for idx, item := range items {
+			args[idx], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		var reply string
+		if strings.ToUpper(args[0]) == "AUTH" {
+			authed = args[len(args)-1] == s.password
+			reply = "-WRONGPASS invalid password\r\n"
+			if authed {
+				reply = "+OK\r\n"
+			}
+		} else if !authed {
+			reply = "-NOAUTH Authentication required\r\n"
+		} else {
+			reply = s.run(args)
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *redisStub) entry(key string) *redisStubEntry {
+	e, ok := s.keys[key]
+	if ok && !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(s.keys, key)
+		return nil
+	}
+	return e
+}
+
+func (s *redisStub) run(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if e := s.entry(args[1]); e != nil {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(e.value), e.value)
+		}
+		return "$-1\r\n"
+	case "SET":
+		e := &redisStubEntry{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.keys[args[1]] = e
+		return "+OK\r\n"
+	case "INCR":
+		e := s.entry(args[1])
+		if e == nil {
+			e = &redisStubEntry{value: "0"}
+			s.keys[args[1]] = e
+		}
+		n, err := strconv.Atoi(e.value)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		e.value = strconv.Itoa(n + 1)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case "PEXPIRE":
+		e := s.entry(args[1])
+		if e == nil {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "PTTL":
+		e := s.entry(args[1])
+		if e == nil {
+			return ":-2\r\n"
+		} else if e.expires.IsZero() {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(e.expires).Milliseconds())
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if s.entry(key) != nil {
+				delete(s.keys, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func (s *redisStub) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.entry(key); e != nil {
+		return e.value, true
+	}
+	return "", false
+}
+
+func newRedisTestServer(t *testing.T, redis RedisConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 3,
+			Redis:       redis,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	return f
+}
+
+func TestRedisSharedBans(t *testing.T) {
+	stub := newRedisStub(t, "secret")
+	config := RedisConfig{Address: stub.address(), Password: "secret", DB: 2, CacheTTL: "0s"}
+	first := newRedisTestServer(t, config)
+	second := newRedisTestServer(t, config)
+
+	// failures on either instance count towards the same ban
+	first.incrementViewCounter("1.1.1.1")
+	second.incrementViewCounter("1.1.1.1")
+	first.incrementViewCounter("1.1.1.1")
+	if value, ok := stub.get("fail2ban:fails:1.1.1.1"); !ok || value != "3" {
+		t.Errorf("Expected 3 shared failures but got %q", value)
+	}
+	if value, ok := stub.get("fail2ban:ban:1.1.1.1"); !ok || !strings.HasPrefix(value, ruleFails) {
+		t.Errorf("Expected a fails ban in redis but got %q", value)
+	}
+	if details := second.isClientBanned("1.1.1.1"); details == nil || details.Reason != ruleFails {
+		t.Errorf("Ban should be seen by the other instance, got %+v", details)
+	}
+
+	// lifting the ban on one instance lifts it everywhere
+	if !first.store.Unban("1.1.1.1") {
+		t.Error("Unban should have found the client")
+	}
+	if details := second.isClientBanned("1.1.1.1"); details != nil {
+		t.Errorf("Ban should have been lifted on the other instance, got %+v", details)
+	}
+	if _, ok := stub.get("fail2ban:fails:1.1.1.1"); ok {
+		t.Error("Unban should have deleted the fail counter")
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	stub := newRedisStub(t, "")
+	s, err := newRedisStore(RedisConfig{Address: stub.address(), CacheTTL: "1h"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Got error %s", err)
+	}
+	s.logger = log.New("test", log.Error)
+	if _, ok := s.Get("1.1.1.1"); ok {
+		t.Error("Unknown client should not exist")
+	}
+	// unknown clients aren't cached
+	stub.run([]string{"SET", "fail2ban:ban:1.1.1.1", ruleScanner, "PX", "3600000"})
+	c, ok := s.Get("1.1.1.1")
+	if !ok || c.rule() != ruleScanner {
+		t.Errorf("Expected a %s ban but got %+v", ruleScanner, c)
+	}
+	if elapsed := time.Since(c.lastViewed); elapsed < 0 || elapsed > time.Minute {
+		t.Errorf("Expected last viewed to come from the key TTL but got %s ago", elapsed)
+	}
+	stub.run([]string{"DEL", "fail2ban:ban:1.1.1.1"})
+	if c, ok := s.Get("1.1.1.1"); !ok || c.rule() != ruleScanner {
+		t.Errorf("Cached read should not have seen the ban lifted yet, got %+v", c)
+	}
+}
+
+func TestRedisCacheUnknownClients(t *testing.T) {
+	stub := newRedisStub(t, "")
+	s, err := newRedisStore(RedisConfig{Address: stub.address(), CacheTTL: "1h"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Got error %s", err)
+	}
+	s.logger = log.New("test", log.Error)
+	for idx := 0; idx < 100; idx++ {
+		s.Get(fmt.Sprintf("10.0.0.%d", idx))
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Expected reads of unknown clients not to be kept, %d tracked", n)
+	}
+}
+
+func TestRedisFailMode(t *testing.T) {
+	// grab a free port with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	tests := map[string]struct {
+		failMode string
+		banned   bool
+		reason   string
+	}{
+		"open counts locally": {failMode: redisFailOpen, banned: true, reason: ruleFails},
+		"closed blocks all":   {failMode: redisFailClosed, banned: true, reason: ruleUnavailable},
+		"open by default":     {failMode: "", banned: true, reason: ruleFails},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := newRedisTestServer(t, RedisConfig{Address: address, FailMode: test.failMode, Timeout: "100ms"})
+			if test.failMode == redisFailClosed {
+				details := f.isClientBanned("2.2.2.2")
+				if details == nil || details.Reason != ruleUnavailable || details.Reference != ruleUnavailable {
+					t.Fatalf("Expected clients to be blocked but got %+v", details)
+				}
+				if left := time.Until(details.Expires); left > redisRetryInterval {
+					t.Errorf("Expected clients to retry within %s but got %s", redisRetryInterval, left)
+				}
+			} else if details := f.isClientBanned("2.2.2.2"); details != nil {
+				t.Errorf("Expected clients to be let through but got %+v", details)
+			}
+			for idx := 0; idx < 3; idx++ {
+				f.incrementViewCounter("1.1.1.1")
+			}
+			details := f.isClientBanned("1.1.1.1")
+			if (details != nil) != test.banned || (details != nil && details.Reason != test.reason) {
+				t.Errorf("Expected banned %t for %q but got %+v", test.banned, test.reason, details)
+			}
+		})
+	}
+}
+
+func TestRedisConfig(t *testing.T) {
+	tests := map[string]struct {
+		config RedisConfig
+		err    string
+	}{
+		"disabled":      {config: RedisConfig{}},
+		"defaults":      {config: RedisConfig{Address: "localhost:6379"}},
+		"bad fail mode": {config: RedisConfig{Address: "localhost:6379", FailMode: "sideways"}, err: "invalid redis fail mode"},
+		"bad timeout":   {config: RedisConfig{Address: "localhost:6379", Timeout: "soon"}, err: "invalid redis timeout"},
+		"bad cache TTL": {config: RedisConfig{Address: "localhost:6379", CacheTTL: "forever"}, err: "invalid redis cache TTL"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := newRedisStore(test.config, time.Hour)
+			if len(test.err) == 0 && err != nil {
+				t.Errorf("Expected no error but got %s", err)
+			} else if len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("Expected error %q but got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestRESPClientConnections(t *testing.T) {
+	stub := newRedisStub(t, "")
+	c := newRESPClient(stub.address(), "", "", 0, 50*time.Millisecond)
+	if _, err := c.pipeline([]string{"GET", "key"}); err != nil {
+		t.Fatalf("Got error %s", err)
+	}
+	if len(c.idle) != 1 {
+		t.Errorf("Expected the connection to be kept idle, got %d", len(c.idle))
+	}
+
+	// every slot in use
+	for idx := 0; idx < maxActiveRedisConns; idx++ {
+		c.active <- struct{}{}
+	}
+	if _, err := c.pipeline([]string{"GET", "key"}); err != errRedisBusy {
+		t.Errorf("Expected %q but got %v", errRedisBusy, err)
+	}
+	for idx := 0; idx < maxActiveRedisConns; idx++ {
+		<-c.active
+	}
+
+	c.close()
+	if _, err := c.pipeline([]string{"GET", "key"}); err != nil {
+		t.Fatalf("Got error %s", err)
+	}
+	if len(c.idle) != 0 {
+		t.Errorf("Expected no idle connections once closed, got %d", len(c.idle))
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected any
+		err      bool
+	}{
+		"simple string": {input: "+OK\r\n", expected: "OK"},
+		"error":         {input: "-ERR nope\r\n", expected: respError("ERR nope")},
+		"integer":       {input: ":42\r\n", expected: int64(42)},
+		"bulk string":   {input: "$5\r\nhe\r\no\r\n", expected: "he\r\no"},
+		"nil bulk":      {input: "$-1\r\n", expected: nil},
+		"nil array":     {input: "*-1\r\n", expected: nil},
+		"short bulk":    {input: "$5\r\nhe", err: true},
+		"no CR":         {input: "+OK\n", err: true},
+		"unknown type":  {input: "?huh\r\n", err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := readRESP(bufio.NewReader(strings.NewReader(test.input)))
+			if test.err != (err != nil) {
+				t.Errorf("Expected error %t but got %v", test.err, err)
+			} else if !test.err && got != test.expected {
+				t.Errorf("Expected %#v but got %#v", test.expected, got)
+			}
+		})
+	}
+
+	got, err := readRESP(bufio.NewReader(strings.NewReader("*3\r\n:1\r\n$-1\r\n+two\r\n")))
+	items, ok := got.([]any)
+	if err != nil || !ok || len(items) != 3 || items[0] != int64(1) || items[1] != nil || items[2] != "two" {
+		t.Errorf("Expected array [1 nil two] but got %#v, error %v", got, err)
+	}
+}
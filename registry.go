@@ -0,0 +1,173 @@
+package fail2ban
+
+import (
+	"context"
+	"sync"
+)
+
+// Traefik calls New again with the same name on every configuration change
+// and for every router using the middleware, and keeps routing requests to
+// the older instances until their context is done. Every instance with the
+// same name shares one registration, stopped once the last one is.
+var registry = struct {
+	mu        sync.Mutex
+	instances map[string]*registration
+}{instances: make(map[string]*registration)}
+
+// Redis connections, journal or gossip senders shared by the instances
+// whose config matches, closed once none of them is running
+type resource interface {
+	close()
+}
+
+// Fields are protected by the registry mutex
+type registration struct {
+	clients *memoryStore
+	stats   *stats
+	// running instances, the cleaner works with the settings of the one
+	// registered last
+	running []*fail2Ban
+	// instance which stopped last, saves the state once all of them did
+	last *fail2Ban
+	// how many running instances use each resource
+	uses map[resource]int
+	// instances being created from this one, it isn't stopped meanwhile
+	pins int
+	// stops the cleaner of the latest instance, so the next one takes over
+	handover context.CancelFunc
+	// stops the cleaner, done is closed once it stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// The registration of the instances running under name, nil if there are
+// none. It and the resources of its instances are kept until unpin is
+// called, so a new instance can join it.
+func pinInstance(name string) *registration {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	r := registry.instances[name]
+	if r != nil {
+		r.pins++
+	}
+	return r
+}
+
+// The instance registered last, or the one which stopped last if none is
+// running while r is pinned
+func (r *registration) latest() *fail2Ban {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if len(r.running) == 0 {
+		return r.last
+	}
+	return r.running[len(r.running)-1]
+}
+
+// Register f with the resources it uses under name, joining the instances
+// of the pinned registration r if there is one
+func registerInstance(name string, r *registration, f *fail2Ban, clients *memoryStore, resources ...resource) *registration {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if r == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		r = &registration{
+			clients: clients,
+			stats:   f.stats,
+			uses:    make(map[resource]int),
+			cancel:  cancel,
+			done:    make(chan struct{}),
+		}
+		registry.instances[name] = r
+		go r.clean(ctx)
+	}
+	r.running = append(r.running, f)
+	for _, res := range resources {
+		r.uses[res]++
+	}
+	if r.handover != nil {
+		r.handover()
+	}
+	return r
+}
+
+// Run the cleaner of the latest instance until every instance stopped
+func (r *registration) clean(ctx context.Context) {
+	defer close(r.done)
+	for {
+		registry.mu.Lock()
+		if ctx.Err() != nil {
+			registry.mu.Unlock()
+			return
+		}
+		f := r.running[len(r.running)-1]
+		cleanerCtx, cancel := context.WithCancel(ctx)
+		r.handover = cancel
+		registry.mu.Unlock()
+		f.cleaner(cleanerCtx)
+		cancel()
+	}
+}
+
+// Remove f once its context is done
+func (r *registration) release(name string, f *fail2Ban, resources ...resource) {
+	registry.mu.Lock()
+	for idx, running := range r.running {
+		if running == f {
+			r.running = append(r.running[:idx], r.running[idx+1:]...)
+			break
+		}
+	}
+	r.last = f
+	for _, res := range resources {
+		r.uses[res]--
+	}
+	if len(r.running) != 0 && r.handover != nil {
+		// the cleaner may have been using f's journal
+		r.handover()
+	}
+	r.stop(name)
+}
+
+// Let r stop once its instances did
+func (r *registration) unpin(name string) {
+	if r == nil {
+		return
+	}
+	registry.mu.Lock()
+	r.pins--
+	r.stop(name)
+}
+
+// Close the resources no running instance uses anymore, and stop the
+// cleaner and save the state once no instance is running. Called with the
+// registry mutex held, releases it.
+func (r *registration) stop(name string) {
+	if r.pins != 0 {
+		registry.mu.Unlock()
+		return
+	}
+	var unused []resource
+	for res, uses := range r.uses {
+		if uses == 0 {
+			delete(r.uses, res)
+			unused = append(unused, res)
+		}
+	}
+	last := len(r.running) == 0
+	if last {
+		if registry.instances[name] == r {
+			delete(registry.instances, name)
+		}
+		r.cancel()
+	}
+	registry.mu.Unlock()
+
+	if last {
+		<-r.done
+		r.last.saveState()
+	}
+	for _, res := range unused {
+		res.close()
+	}
+}
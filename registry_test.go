@@ -0,0 +1,251 @@
+package fail2ban
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newRegistryTestServer(t *testing.T, ctx context.Context, name string, config *Config) *fail2Ban {
+	config.LogLevel = "ERROR"
+	return newNamedTestServer(t, ctx, name, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+// The registration of the instances running under name
+func registered(name string) *registration {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return registry.instances[name]
+}
+
+// How many instances are running under r
+func running(r *registration) int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return len(r.running)
+}
+
+// Wait a second for the registration's cleaner to stop
+func stopped(r *registration) bool {
+	select {
+	case <-r.done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestRegistryTakeOver(t *testing.T) {
+	name := uniqueName()
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	old := newRegistryTestServer(t, ctx, name, CreateConfig())
+	old.store.Ban("1.1.1.1", ruleScanner, time.Now())
+	old.stats.record(eventBlocked)
+	r := registered(name)
+
+	// an invalid configuration leaves the running instance alone
+	invalid := CreateConfig()
+	invalid.BanTime = "forever"
+	if _, err := New(context.TODO(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), invalid, name); err == nil {
+		t.Fatal("Expected an error for an invalid ban time")
+	}
+	if registered(name) != r || running(r) != 1 {
+		t.Fatal("Invalid configuration should not have registered an instance")
+	}
+
+	config := CreateConfig()
+	config.NumberFails = 10
+	rebuilt := newRegistryTestServer(t, ctx, name, config)
+	if registered(name) != r || running(r) != 2 {
+		t.Fatal("New instance should have joined the running one")
+	}
+	if rebuilt.isClientBanned("1.1.1.1") == nil {
+		t.Error("Ban should have survived the new configuration")
+	}
+	if rebuilt.maxFails != 10 {
+		t.Errorf("Expected the new NumberFails 10 but got %d", rebuilt.maxFails)
+	}
+	if rebuilt.snapshotStats().Events[eventBlocked] != 1 {
+		t.Error("Stats should have been taken over")
+	}
+	// both instances see the same clients, the old one may still be serving
+	rebuilt.store.Ban("2.2.2.2", ruleBandwidth, time.Now())
+	if old.isClientBanned("2.2.2.2") == nil {
+		t.Error("Old instance should see bans made by the new one")
+	}
+
+	other := newRegistryTestServer(t, ctx, uniqueName(), CreateConfig())
+	if other.isClientBanned("1.1.1.1") != nil {
+		t.Error("Instances with other names should not share clients")
+	}
+}
+
+func TestRegistryStopped(t *testing.T) {
+	name := uniqueName()
+	oldCtx, cancelOld := context.WithCancel(context.TODO())
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	old := newRegistryTestServer(t, oldCtx, name, CreateConfig())
+	r := registered(name)
+	newRegistryTestServer(t, ctx, name, CreateConfig())
+
+	// the old instance stopping leaves the new one running
+	cancelOld()
+	if stopped(r) {
+		t.Fatal("Cleaner should keep running for the new instance")
+	}
+	if registered(name) != r || running(r) != 1 || r.latest() == old {
+		t.Fatal("Only the old instance should have been unregistered")
+	}
+
+	cancel()
+	if !stopped(r) {
+		t.Fatal("Cleaner should have been stopped")
+	}
+	if registered(name) != nil {
+		t.Error("Registration should have been removed once every instance stopped")
+	}
+}
+
+func TestRegistryResources(t *testing.T) {
+	name := uniqueName()
+	oldCtx, cancelOld := context.WithCancel(context.TODO())
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := CreateConfig()
+	config.Redis.Address = "127.0.0.1:1"
+	config.Gossip.Peers = []string{"http://127.0.0.1:1"}
+	config.Gossip.Secret = "secret"
+	old := newRegistryTestServer(t, oldCtx, name, config)
+	r := registered(name)
+
+	config = CreateConfig()
+	config.NumberFails = 10
+	config.Redis.Address = "127.0.0.1:1"
+	config.Gossip.Peers = []string{"http://127.0.0.1:1"}
+	config.Gossip.Secret = "secret"
+	same := newRegistryTestServer(t, ctx, name, config)
+	if same.redis.client != old.redis.client || same.gossip != old.gossip {
+		t.Error("Unchanged Redis and gossip settings should share the running connections and senders")
+	}
+
+	config = CreateConfig()
+	config.Redis.Address = "127.0.0.1:2"
+	config.Gossip.Peers = []string{"http://127.0.0.1:2"}
+	config.Gossip.Secret = "secret"
+	changed := newRegistryTestServer(t, ctx, name, config)
+	if changed.redis.client == old.redis.client || changed.gossip == old.gossip {
+		t.Error("Changed Redis and gossip settings should get their own connections and senders")
+	}
+
+	// still used by the other instance with the same settings
+	cancelOld()
+	if !eventually(func() bool { return running(r) == 2 }) {
+		t.Fatal("Old instance should have been unregistered")
+	}
+	old.redis.client.mu.Lock()
+	closed := old.redis.client.closed
+	old.redis.client.mu.Unlock()
+	if closed {
+		t.Error("Redis connections still in use should not have been closed")
+	}
+
+	cancel()
+	if !stopped(r) {
+		t.Fatal("Cleaner should have been stopped")
+	}
+	for _, f := range []*fail2Ban{same, changed} {
+		if !eventually(func() bool {
+			f.redis.client.mu.Lock()
+			defer f.redis.client.mu.Unlock()
+			return f.redis.client.closed
+		}) {
+			t.Errorf("Redis connections to %q should have been closed", f.redis.client.address)
+		}
+	}
+}
+
+func TestRegistryJournal(t *testing.T) {
+	name := uniqueName()
+	file := filepath.Join(t.TempDir(), "journal")
+	ctx, cancel := context.WithCancel(context.TODO())
+	config := CreateConfig()
+	config.Journal.File = file
+	old := newRegistryTestServer(t, ctx, name, config)
+	r := registered(name)
+
+	// an invalid configuration leaves the running instance's journal alone
+	invalid := CreateConfig()
+	invalid.Journal = JournalConfig{File: file, MaxBytes: 1}
+	invalid.Gossip.Peers = []string{"http://peer:8000"}
+	if _, err := New(context.TODO(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), invalid, name); err == nil {
+		t.Fatal("Expected an error for gossip without a secret")
+	}
+	if old.journal.maxBytes == 1 {
+		t.Error("Invalid configuration should not have changed the journal")
+	}
+
+	rebuilt := newRegistryTestServer(t, ctx, name, config)
+	if rebuilt.journal != old.journal {
+		t.Fatal("Instances should append to the same journal")
+	}
+
+	// requests still reaching the old instance keep being journaled
+	old.store.Ban("1.1.1.1", ruleScanner, time.Now())
+	rebuilt.store.Ban("2.2.2.2", ruleScanner, time.Now())
+	cancel()
+	if !stopped(r) {
+		t.Fatal("Cleaner should have been stopped")
+	}
+	if !eventually(func() bool {
+		old.journal.mu.Lock()
+		defer old.journal.mu.Unlock()
+		return old.journal.file == nil
+	}) {
+		t.Fatal("Journal should have been closed once every instance stopped")
+	}
+
+	bans := 0
+	if _, _, err := readJournal(file, func(r journalRecord) {
+		if r.Op == journalBan {
+			bans++
+		}
+	}); err != nil {
+		t.Fatalf("Failed to read journal: %s", err)
+	}
+	if bans != 2 {
+		t.Errorf("Expected 2 bans journaled but got %d", bans)
+	}
+}
+
+func TestRegistryClosedJournal(t *testing.T) {
+	name := uniqueName()
+	file := filepath.Join(t.TempDir(), "journal")
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	config := CreateConfig()
+	config.Journal.File = file
+	old := newRegistryTestServer(t, ctx, name, config)
+	old.journal.close()
+	rebuilt := newRegistryTestServer(t, ctx, name, config)
+
+	rebuilt.store.Ban("1.1.1.1", ruleScanner, time.Now())
+	rebuilt.journal.sync()
+	rebuilt.journal.mu.Lock()
+	defer rebuilt.journal.mu.Unlock()
+	if rebuilt.journal.file == nil {
+		t.Fatal("Journal closed meanwhile should have been reopened")
+	}
+	bans := 0
+	readJournal(file, func(r journalRecord) {
+		if r.Op == journalBan {
+			bans++
+		}
+	})
+	if bans != 1 {
+		t.Errorf("Expected 1 ban journaled but got %d", bans)
+	}
+}
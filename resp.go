@@ -0,0 +1,259 @@
+package fail2ban
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of idle connections kept to the Redis server
+	maxIdleRedisConns = 8
+	// maximum number of connections to the Redis server in use at once
+	maxActiveRedisConns = 64
+)
+
+var errRedisBusy = errors.New("too many Redis connections in use")
+
+// Error reply from the Redis server
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// Minimal RESP2 client, the plugin can't pull in a Redis library
+type respClient struct {
+	address  string
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *respConn
+	// a slot is taken for every connection in use
+	active chan struct{}
+
+	// mutex protects closed, connections aren't kept idle once it is set
+	mu     sync.Mutex
+	closed bool
+}
+
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func newRESPClient(address string, username string, password string, db int, timeout time.Duration) *respClient {
+	return &respClient{
+		address:  address,
+		username: username,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		idle:     make(chan *respConn, maxIdleRedisConns),
+		active:   make(chan struct{}, maxActiveRedisConns),
+	}
+}
+
+// Whether other talks to the same server the same way, so its connections
+// can be used instead
+func (c *respClient) sameServer(other *respClient) bool {
+	return c.address == other.address && c.username == other.username && c.password == other.password &&
+		c.db == other.db && c.timeout == other.timeout
+}
+
+func (c *respClient) dial() (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	var setup [][]string
+	if len(c.password) != 0 {
+		if len(c.username) != 0 {
+			setup = append(setup, []string{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) != 0 {
+		if _, err := rc.pipeline(c.timeout, setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Send commands in one go and read their replies. Error replies are
+// returned in place of the reply and don't fail the pipeline.
+func (c *respClient) pipeline(cmds ...[]string) ([]any, error) {
+	timer := time.NewTimer(c.timeout)
+	select {
+	case c.active <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		return nil, errRedisBusy
+	}
+	defer func() { <-c.active }()
+
+	var rc *respConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := rc.pipeline(c.timeout, cmds)
+	if err != nil {
+		// the connection is in an unknown state
+		rc.conn.Close()
+		return nil, err
+	}
+	c.mu.Lock()
+	if !c.closed {
+		select {
+		case c.idle <- rc:
+			rc = nil
+		default:
+		}
+	}
+	c.mu.Unlock()
+	if rc != nil {
+		rc.conn.Close()
+	}
+	return replies, nil
+}
+
+// Close the idle connections, connections in use are closed once done with
+func (c *respClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *respConn) pipeline(timeout time.Duration, cmds [][]string) ([]any, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	for _, args := range cmds {
+		fmt.Fprintf(rc.writer, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(rc.writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := rc.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	for idx := range replies {
+		reply, err := readRESP(rc.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[idx] = reply
+	}
+	return replies, nil
+}
+
+// Read a reply. Simple strings and bulk strings are strings, integers are
+// int64, arrays are []any, nil replies are nil and errors are respError.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid RESP line %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return respError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESP bulk length %q", value)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buff := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buff); err != nil {
+			return nil, err
+		}
+		return string(buff[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESP array length %q", value)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for idx := range items {
+			if items[idx], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", kind)
+	}
+}
+
+var errRESPType = errors.New("unexpected RESP reply type")
+
+// Integer from a reply, nil replies are 0
+func respInt(reply any) (int64, error) {
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case respError:
+		return 0, v
+	default:
+		return 0, errRESPType
+	}
+}
+
+// String from a reply, nil replies are empty
+func respString(reply any) (string, error) {
+	switch v := reply.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case respError:
+		return "", v
+	default:
+		return "", errRESPType
+	}
+}
@@ -0,0 +1,269 @@
+package fail2ban
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// BanResponseConfig controls what banned clients get sent
+type BanResponseConfig struct {
+	StatusCode int
+	Headers    map[string]string
+	// Body is a Go template sent to every client, with the fields of
+	// banTemplateData available. Overrides the negotiated bodies below.
+	Body string
+	// ContentType of the body, html/template is used for text/html bodies
+	ContentType string
+	// Bodies picked between using the client's Accept header, built in
+	// defaults are used for any which are not set
+	HTMLBody string
+	JSONBody string
+	TextBody string
+	// BanHeaders adds X-Ban-Expires and X-Ban-Reason headers
+	BanHeaders bool
+}
+
+// Details about a ban
+type banDetails struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Expires   time.Time `json:"expires"`
+	Reference string    `json:"reference"`
+}
+
+// Data available to ban response templates
+type banTemplateData struct {
+	banDetails
+	Status     int
+	StatusText string
+}
+
+const (
+	defaultHTMLBody = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>Too many bad requests have been made from {{.IP}}, access is blocked until {{.Expires.UTC.Format "2006-01-02 15:04:05 MST"}}.</p>
+<p>If you think this is a mistake, contact support with reference <code>{{.Reference}}</code>.</p>
+</body>
+</html>
+`
+	defaultJSONBody = `{"type":"about:blank","title":{{json .StatusText}},"status":{{.Status}},"detail":"Too many bad requests, access is blocked","client":{{json .IP}},"reason":{{json .Reason}},"expires":{{json .Expires}},"reference":{{json .Reference}}}
+`
+	defaultTextBody = `{{.StatusText}}: too many bad requests have been made from {{.IP}}, access is blocked until {{.Expires.UTC.Format "2006-01-02 15:04:05 MST"}}. Reference {{.Reference}}
+`
+)
+
+var templateFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+type bodyTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+type banBody struct {
+	contentType string
+	template    bodyTemplate
+}
+
+func newBanBody(body string, contentType string) (*banBody, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ban response content type: %w", err)
+	}
+	b := &banBody{contentType: contentType}
+	if mediaType == "text/html" {
+		b.template, err = htmltemplate.New("ban").Funcs(templateFuncs).Parse(body)
+	} else {
+		b.template, err = template.New("ban").Funcs(templateFuncs).Parse(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid ban response body: %w", err)
+	}
+	// catch references to fields which don't exist now rather than on the first ban
+	if err := b.template.Execute(io.Discard, banTemplateData{}); err != nil {
+		return nil, fmt.Errorf("invalid ban response body: %w", err)
+	}
+	return b, nil
+}
+
+// media types offered to clients, ties in the Accept header go to the first
+var offeredMediaTypes = []string{
+	"application/problem+json",
+	"application/json",
+	"text/html",
+	"text/plain",
+}
+
+type banResponse struct {
+	statusCode int
+	headers    map[string]string
+	banHeaders bool
+	// custom body sent regardless of the Accept header
+	body *banBody
+	// bodies keyed by offered media type
+	negotiated map[string]*banBody
+}
+
+func newBanResponse(config BanResponseConfig) (*banResponse, error) {
+	b := &banResponse{
+		statusCode: http.StatusForbidden,
+		headers:    config.Headers,
+		banHeaders: config.BanHeaders,
+	}
+	if config.StatusCode != 0 {
+		if config.StatusCode < 200 || config.StatusCode > 599 {
+			return nil, fmt.Errorf("invalid ban response status code %d", config.StatusCode)
+		}
+		b.statusCode = config.StatusCode
+	}
+
+	var err error
+	if len(config.Body) != 0 {
+		contentType := config.ContentType
+		if len(contentType) == 0 {
+			contentType = "text/plain; charset=utf-8"
+		}
+		b.body, err = newBanBody(config.Body, contentType)
+		return b, err
+	}
+
+	bodies := []struct {
+		name        string
+		body        string
+		fallback    string
+		contentType string
+	}{
+		{"HTML", config.HTMLBody, defaultHTMLBody, "text/html; charset=utf-8"},
+		{"JSON", config.JSONBody, defaultJSONBody, "application/problem+json"},
+		{"text", config.TextBody, defaultTextBody, "text/plain; charset=utf-8"},
+	}
+	parsed := make([]*banBody, len(bodies))
+	for idx, body := range bodies {
+		if len(body.body) == 0 {
+			body.body = body.fallback
+		}
+		if parsed[idx], err = newBanBody(body.body, body.contentType); err != nil {
+			return nil, fmt.Errorf("%s: %w", body.name, err)
+		}
+	}
+	b.negotiated = map[string]*banBody{
+		"text/html":                parsed[0],
+		"application/problem+json": parsed[1],
+		"application/json":         {contentType: "application/json", template: parsed[1].template},
+		"text/plain":               parsed[2],
+	}
+	return b, nil
+}
+
+// Pick the body the client prefers from its Accept header. Clients which
+// don't name any of the offered types, eg with */* or no Accept header,
+// get plain text.
+func (b *banResponse) negotiate(accept string) *banBody {
+	if b.body != nil {
+		return b.body
+	}
+	best, bestQ, bestExplicit := "", -1.0, false
+	for _, mediaType := range offeredMediaTypes {
+		q, explicit := acceptQuality(accept, mediaType)
+		if q > bestQ || (q == bestQ && explicit && !bestExplicit) {
+			best, bestQ, bestExplicit = mediaType, q, explicit
+		}
+	}
+	if !bestExplicit || bestQ == 0 {
+		return b.negotiated["text/plain"]
+	}
+	return b.negotiated[best]
+}
+
+// Quality the Accept header gives mediaType, using the most specific match,
+// and whether the type was asked for by name or type/* rather than only
+// through */*. Returns 0 when the media type is not acceptable.
+func acceptQuality(accept string, mediaType string) (float64, bool) {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return 1, false
+	}
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		accepted, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		var s int
+		switch accepted {
+		case mediaType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q, specificity > 0
+}
+
+func (b *banResponse) write(rw http.ResponseWriter, req *http.Request, details banDetails) error {
+	for k, v := range b.headers {
+		rw.Header().Set(k, v)
+	}
+	rw.Header().Set("Retry-After", retryAfter(time.Until(details.Expires)))
+	if b.banHeaders {
+		rw.Header().Set("X-Ban-Expires", details.Expires.UTC().Format(http.TimeFormat))
+		rw.Header().Set("X-Ban-Reason", details.Reason)
+	}
+	body := b.negotiate(req.Header.Get("Accept"))
+	if b.body == nil {
+		rw.Header().Add("Vary", "Accept")
+	}
+	var buff bytes.Buffer
+	data := banTemplateData{
+		banDetails: details,
+		Status:     b.statusCode,
+		StatusText: http.StatusText(b.statusCode),
+	}
+	if err := body.template.Execute(&buff, data); err != nil {
+		rw.WriteHeader(b.statusCode)
+		return err
+	}
+	rw.Header().Set("Content-Type", body.contentType)
+	rw.WriteHeader(b.statusCode)
+	_, err := rw.Write(buff.Bytes())
+	return err
+}
+
+// Random ID support can use to look up a ban in the logs
+func newReference() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
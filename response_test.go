@@ -0,0 +1,288 @@
+package fail2ban
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBanResponseTestServer(t *testing.T, config BanResponseConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 2,
+			BanResponse: config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	return f
+}
+
+func serveBanned(f *fail2Ban, client string) *httptest.ResponseRecorder {
+	var response *httptest.ResponseRecorder
+	for idx := 0; idx < 3; idx++ {
+		response = httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://garbage", nil)
+		request.RemoteAddr = client + ":5678"
+		f.ServeHTTP(response, request)
+	}
+	return response
+}
+
+func TestDefaultBanResponse(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{})
+	tests := map[string]struct {
+		accept      string
+		contentType string
+		contains    string
+	}{
+		"browser": {
+			"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			"text/html; charset=utf-8",
+			"<code>",
+		},
+		"problem json": {
+			"application/problem+json",
+			"application/problem+json",
+			`"status":403`,
+		},
+		"json": {
+			"application/json",
+			"application/json",
+			`"reason":"fails"`,
+		},
+		"any": {
+			"*/*",
+			"text/plain; charset=utf-8",
+			"Forbidden:",
+		},
+		"no accept header": {
+			"",
+			"text/plain; charset=utf-8",
+			"Forbidden:",
+		},
+		"named over any": {
+			"text/html;q=0.5, */*",
+			"text/plain; charset=utf-8",
+			"Forbidden:",
+		},
+		"json and any": {
+			"application/json, */*;q=0.8",
+			"application/json",
+			`"client":"1.2.3.4"`,
+		},
+		"plain text": {
+			"text/plain",
+			"text/plain; charset=utf-8",
+			"Forbidden: too many bad requests have been made from 1.2.3.4",
+		},
+		"text preferred": {
+			"text/html;q=0.5, text/*",
+			"text/plain; charset=utf-8",
+			"Forbidden:",
+		},
+		"nothing acceptable": {
+			"image/png",
+			"text/plain; charset=utf-8",
+			"Forbidden:",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			response := serveBannedWithAccept(f, "1.2.3.4", test.accept)
+			if response.Code != http.StatusForbidden {
+				t.Errorf("Expected response to be %d but got %d", http.StatusForbidden, response.Code)
+			}
+			if response.Header().Get("Content-Type") != test.contentType {
+				t.Errorf("Expected content type %q, got %q", test.contentType, response.Header().Get("Content-Type"))
+			}
+			if response.Header().Get("Vary") != "Accept" {
+				t.Error("Expected Vary header")
+			}
+			if !strings.Contains(response.Body.String(), test.contains) {
+				t.Errorf("Expected body to contain %q, got %q", test.contains, response.Body.String())
+			}
+		})
+	}
+}
+
+func serveBannedWithAccept(f *fail2Ban, client string, accept string) *httptest.ResponseRecorder {
+	var response *httptest.ResponseRecorder
+	for idx := 0; idx < 3; idx++ {
+		response = httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://garbage", nil)
+		request.RemoteAddr = client + ":5678"
+		request.Header.Set("Accept", accept)
+		f.ServeHTTP(response, request)
+	}
+	return response
+}
+
+func TestDefaultJSONBanResponseIsValid(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{})
+	response := serveBannedWithAccept(f, `1.2.3.4"`, "application/json")
+	problem := map[string]any{}
+	if err := json.Unmarshal(response.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", response.Body.String(), err)
+	}
+	if problem["client"] != `1.2.3.4"` || problem["title"] != "Forbidden" {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+}
+
+func TestCustomNegotiatedBanResponse(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{
+		StatusCode: http.StatusTooManyRequests,
+		HTMLBody:   "<p>{{.StatusText}}</p>",
+		JSONBody:   `{"status":{{.Status}}}`,
+	})
+	if response := serveBannedWithAccept(f, "1.2.3.4", "text/html"); response.Body.String() != "<p>Too Many Requests</p>" {
+		t.Errorf("Unexpected HTML body %q", response.Body.String())
+	}
+	if response := serveBannedWithAccept(f, "1.2.3.4", "application/json"); response.Body.String() != `{"status":429}` {
+		t.Errorf("Unexpected JSON body %q", response.Body.String())
+	}
+	if response := serveBannedWithAccept(f, "1.2.3.4", "text/plain"); !strings.HasPrefix(response.Body.String(), "Too Many Requests: ") {
+		t.Errorf("Text body should fall back to the default, got %q", response.Body.String())
+	}
+}
+
+func TestAcceptQuality(t *testing.T) {
+	tests := map[string]struct {
+		accept    string
+		mediaType string
+		q         float64
+	}{
+		"empty":         {"", "text/html", 1},
+		"exact":         {"text/html", "text/html", 1},
+		"q value":       {"text/html;q=0.4", "text/html", 0.4},
+		"wildcard":      {"text/*;q=0.3", "text/plain", 0.3},
+		"most specific": {"*/*;q=0.1, text/*;q=0.2, text/plain;q=0.7", "text/plain", 0.7},
+		"refused":       {"text/plain;q=0, */*", "text/plain", 0},
+		"no match":      {"image/png", "text/plain", 0},
+		"garbage":       {";;;, text/plain", "text/plain", 1},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if q, _ := acceptQuality(test.accept, test.mediaType); q != test.q {
+				t.Errorf("Expected %v, got %v", test.q, q)
+			}
+		})
+	}
+}
+
+func TestTextBanResponse(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{
+		StatusCode: http.StatusTooManyRequests,
+		Headers:    map[string]string{"x-support": "support@example.com"},
+		Body:       "{{.IP}} banned for {{.Reason}} until {{.Expires.Format \"2006\"}}, ref {{.Reference}}",
+	})
+	response := serveBanned(f, "1.2.3.4")
+	if response.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected response to be %d but got %d", http.StatusTooManyRequests, response.Code)
+	}
+	if response.Header().Get("X-Support") != "support@example.com" {
+		t.Errorf("Expected configured header, got %v", response.Header())
+	}
+	if response.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Unexpected content type %q", response.Header().Get("Content-Type"))
+	}
+	info, _ := f.inspectClient("1.2.3.4")
+	expected := "1.2.3.4 banned for fails until " + time.Now().Format("2006") + ", ref " + info.BanReference
+	if len(info.BanReference) == 0 || response.Body.String() != expected {
+		t.Errorf("Expected body %q, got %q", expected, response.Body.String())
+	}
+}
+
+func TestHTMLBanResponse(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{
+		ContentType: "text/html; charset=utf-8",
+		Body:        "<p>{{.IP}}</p>",
+	})
+	response := httptest.NewRecorder()
+	for idx := 0; idx < 3; idx++ {
+		response = httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://garbage", nil)
+		request.RemoteAddr = "[<b>]:5678"
+		f.ServeHTTP(response, request)
+	}
+	if !strings.Contains(response.Body.String(), "&lt;b&gt;") {
+		t.Errorf("HTML body should be escaped, got %q", response.Body.String())
+	}
+}
+
+func TestBanResponseConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  BanResponseConfig
+		isError bool
+	}{
+		"defaults":       {BanResponseConfig{}, false},
+		"status code":    {BanResponseConfig{StatusCode: 451}, false},
+		"bad status":     {BanResponseConfig{StatusCode: 42}, true},
+		"informational":  {BanResponseConfig{StatusCode: 101}, true},
+		"unknown status": {BanResponseConfig{StatusCode: 600}, true},
+		"bad template":   {BanResponseConfig{Body: "{{.IP"}, true},
+		"unknown field":  {BanResponseConfig{Body: "{{.Garbage}}"}, true},
+		"bad media type": {BanResponseConfig{Body: "hi", ContentType: "/"}, true},
+		"bad html body":  {BanResponseConfig{HTMLBody: "{{.Garbage}}"}, true},
+		"bad json body":  {BanResponseConfig{JSONBody: "{{json}"}, true},
+		"bad text body":  {BanResponseConfig{TextBody: "{{.IP"}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newBanResponse(test.config); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestBanHeaders(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{})
+	response := serveBanned(f, "1.2.3.4")
+	if response.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected Retry-After to be the rest of the ban, got %q", response.Header().Get("Retry-After"))
+	}
+	if response.Header().Get("X-Ban-Expires") != "" || response.Header().Get("X-Ban-Reason") != "" {
+		t.Error("Ban headers should be off by default")
+	}
+
+	f = newBanResponseTestServer(t, BanResponseConfig{BanHeaders: true})
+	response = serveBanned(f, "1.2.3.4")
+	expires, err := http.ParseTime(response.Header().Get("X-Ban-Expires"))
+	if err != nil || expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Expected X-Ban-Expires an hour from now, got %q", response.Header().Get("X-Ban-Expires"))
+	}
+	if response.Header().Get("X-Ban-Reason") != ruleFails {
+		t.Errorf("Expected X-Ban-Reason %q, got %q", ruleFails, response.Header().Get("X-Ban-Reason"))
+	}
+}
+
+func TestBanDetails(t *testing.T) {
+	f := newBanResponseTestServer(t, BanResponseConfig{})
+	memory(f).clients["1.2.3.4"] = &client{
+		lastViewed: time.Now(),
+		banRule:    ruleScanner,
+	}
+	start := time.Now()
+	ban := f.isClientBanned("1.2.3.4")
+	if ban == nil {
+		t.Fatal("Client should be banned")
+	}
+	if ban.IP != "1.2.3.4" || ban.Reason != ruleScanner || len(ban.Reference) == 0 {
+		t.Errorf("Unexpected ban details %+v", ban)
+	}
+	if ban.Expires.Before(start.Add(f.banTime)) {
+		t.Errorf("Ban should expire a ban time from now, got %s", ban.Expires)
+	}
+	if again := f.isClientBanned("1.2.3.4"); again.Reference != ban.Reference {
+		t.Error("Ban reference should not change while banned")
+	}
+}
@@ -0,0 +1,61 @@
+package fail2ban
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// ScannerConfig bans clients enumerating lots of different failing paths
+type ScannerConfig struct {
+	// MaxDistinctPaths a client can fail on per window, 0 disables scanner detection
+	MaxDistinctPaths uint
+	Window           string
+	// Mode is "enforce" or "monitor", defaults to the top level Mode
+	Mode string
+}
+
+type scanner struct {
+	maxPaths uint
+	window   time.Duration
+}
+
+func newScanner(config ScannerConfig) (*scanner, error) {
+	if config.MaxDistinctPaths == 0 {
+		return nil, nil
+	}
+	window := 10 * time.Minute
+	if len(config.Window) != 0 {
+		d, err := time.ParseDuration(config.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scanner window: %w", err)
+		}
+		window = d
+	}
+	return &scanner{
+		maxPaths: config.MaxDistinctPaths,
+		window:   window,
+	}, nil
+}
+
+// Set of path hashes, never grows past the limit it is given so a client
+// can only ever cost a bounded amount of memory
+type pathSet struct {
+	start  time.Time
+	hashes map[uint64]struct{}
+}
+
+// Add path to the set and return the number of distinct paths in the window
+func (s *pathSet) add(now time.Time, path string, limit uint, window time.Duration) uint {
+	if s.hashes == nil || now.After(s.start.Add(window)) {
+		s.start = now
+		s.hashes = make(map[uint64]struct{})
+	}
+	if uint(len(s.hashes)) >= limit {
+		return uint(len(s.hashes))
+	}
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	s.hashes[h.Sum64()] = struct{}{}
+	return uint(len(s.hashes))
+}
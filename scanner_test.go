@@ -0,0 +1,79 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScannerBanned(t *testing.T) {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 100,
+			Scanner: ScannerConfig{
+				MaxDistinctPaths: 5,
+				Window:           "1m",
+			},
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+
+	serve := func(client string, path string) int {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://garbage"+path, nil)
+		request.RemoteAddr = client + ":5678"
+		f.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// the same broken link over and over is tolerated
+	for idx := 0; idx < 50; idx++ {
+		if code := serve("1.1.1.1", "/broken.png"); code != http.StatusNotFound {
+			t.Errorf("Expected response to be %d but got %d", http.StatusNotFound, code)
+		}
+	}
+
+	// different paths get banned
+	for idx := uint(0); idx < 10; idx++ {
+		code := serve("2.2.2.2", fmt.Sprintf("/wp-admin/%d.php", idx))
+		if idx < 5 && code != http.StatusNotFound {
+			t.Errorf("Expected response for request %d to be %d but got %d", idx, http.StatusNotFound, code)
+		}
+		if idx >= 5 && code != http.StatusForbidden {
+			t.Errorf("Expected response for request %d to be %d but got %d", idx, http.StatusForbidden, code)
+		}
+	}
+
+	info, _ := f.inspectClient("2.2.2.2")
+	if !info.Banned || info.BanRule != ruleScanner {
+		t.Errorf("Client should be banned by %q, got %+v", ruleScanner, info)
+	}
+	info, _ = f.inspectClient("1.1.1.1")
+	if info.Banned || info.FailedPaths != 1 {
+		t.Errorf("Client should not be banned and have 1 failed path, got %+v", info)
+	}
+}
+
+func TestPathSet(t *testing.T) {
+	now := time.Now()
+	s := pathSet{}
+	for idx := 0; idx < 100; idx++ {
+		s.add(now, fmt.Sprintf("/%d", idx), 10, time.Minute)
+	}
+	if len(s.hashes) != 10 {
+		t.Errorf("Path set should be bounded to 10, got %d", len(s.hashes))
+	}
+	if s.add(now.Add(2*time.Minute), "/", 10, time.Minute) != 1 {
+		t.Error("Path set should reset after window")
+	}
+	if s.add(now.Add(2*time.Minute), "/", 10, time.Minute) != 1 {
+		t.Error("Same path should only be counted once")
+	}
+}
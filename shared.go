@@ -0,0 +1,198 @@
+package fail2ban
+
+import (
+	"sync"
+	"time"
+)
+
+// Ban tables shared by instances with the same SharedList name
+var sharedLists = struct {
+	mu    sync.Mutex
+	lists map[string]*banList
+}{lists: make(map[string]*banList)}
+
+// The ban table shared under name, created on first use. It is dropped once
+// close was called as many times.
+func sharedBanList(name string) *banList {
+	sharedLists.mu.Lock()
+	defer sharedLists.mu.Unlock()
+	list, ok := sharedLists.lists[name]
+	if !ok {
+		list = &banList{name: name, bans: make(map[string]sharedBan)}
+		sharedLists.lists[name] = list
+	}
+	list.users++
+	return list
+}
+
+// Stop using the list
+func (l *banList) close() {
+	sharedLists.mu.Lock()
+	defer sharedLists.mu.Unlock()
+	if l.users--; l.users == 0 {
+		delete(sharedLists.lists, l.name)
+	}
+}
+
+// A ban lasts as long as the instance which made or last extended it says
+type sharedBan struct {
+	rule    string
+	ref     string
+	expires time.Time
+}
+
+type banList struct {
+	name string
+	// protected by the sharedLists mutex
+	users int
+
+	mu   sync.Mutex
+	bans map[string]sharedBan
+}
+
+func (l *banList) get(ip string, now time.Time) (sharedBan, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[ip]
+	return b, ok && now.Before(b.expires)
+}
+
+// Add or extend a ban, it never gets shorter
+func (l *banList) set(ip string, b sharedBan) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, ok := l.bans[ip]; ok && current.expires.After(b.expires) {
+		b.expires = current.expires
+	}
+	l.bans[ip] = b
+}
+
+func (l *banList) lift(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.bans, ip)
+}
+
+func (l *banList) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.bans {
+		if !now.Before(b.expires) {
+			delete(l.bans, ip)
+		}
+	}
+}
+
+// Keeps bans in a list shared with other instances, fail counters and
+// detector state stay with this instance
+type sharedStore struct {
+	Store
+	list    *banList
+	banTime time.Duration
+	// keep bans made here from being pulled before they are pushed
+	clients clientLocks
+}
+
+// Share the bans the store already has, eg restored from a state file
+func (s *sharedStore) seed() {
+	var bans []string
+	s.Store.Range(func(ip string, c client) bool {
+		if len(c.banRule) != 0 {
+			bans = append(bans, ip)
+		}
+		return true
+	})
+	for _, ip := range bans {
+		if c, ok := s.Store.Get(ip); ok && len(c.banRule) != 0 {
+			s.push(ip, c)
+		}
+	}
+}
+
+// Copy a ban made by another instance into this instance's client. Its
+// last view is set so the ban expires when the shared one does. A ban
+// which is gone from the list before expiring here was lifted elsewhere.
+func (s *sharedStore) pull(ip string) {
+	b, ok := s.list.get(ip, time.Now())
+	if !ok {
+		if c, found := s.Store.Get(ip); found && s.lifts(c) {
+			s.Store.Unban(ip)
+		}
+		return
+	}
+	lastViewed := b.expires.Add(-s.banTime)
+	s.Store.Update(ip, true, func(c *client) bool {
+		if len(c.banRule) != 0 && !lastViewed.After(c.lastViewed) {
+			return true
+		}
+		c.banRule = b.rule
+		c.banRef = b.ref
+		if lastViewed.After(c.lastViewed) {
+			c.lastViewed = lastViewed
+		}
+		c.match(b.rule)
+		return true
+	})
+}
+
+func (s *sharedStore) push(ip string, c client) {
+	s.list.set(ip, sharedBan{rule: c.banRule, ref: c.banRef, expires: c.lastViewed.Add(s.banTime)})
+}
+
+// Whether removing the client lifts a ban rather than it expiring, the
+// list expires bans by itself
+func (s *sharedStore) lifts(c client) bool {
+	return len(c.banRule) != 0 && !c.hasBanExpired(time.Now(), s.banTime)
+}
+
+func (s *sharedStore) Get(ip string) (client, bool) {
+	defer s.clients.lock(ip)()
+	s.pull(ip)
+	return s.Store.Get(ip)
+}
+
+func (s *sharedStore) Ban(ip string, rule string, now time.Time) {
+	defer s.clients.lock(ip)()
+	s.Store.Ban(ip, rule, now)
+	if c, ok := s.Store.Get(ip); ok && len(c.banRule) != 0 {
+		s.push(ip, c)
+	}
+}
+
+func (s *sharedStore) Unban(ip string) bool {
+	defer s.clients.lock(ip)()
+	c, _ := s.Store.Get(ip)
+	ok := s.Store.Unban(ip)
+	if s.lifts(c) {
+		s.list.lift(ip)
+	}
+	return ok
+}
+
+func (s *sharedStore) Update(ip string, create bool, fn func(c *client) bool) bool {
+	defer s.clients.lock(ip)()
+	s.pull(ip)
+	var before, after client
+	kept := true
+	ok := s.Store.Update(ip, create, func(c *client) bool {
+		before = *c
+		kept = fn(c)
+		after = *c
+		return kept
+	})
+	switch {
+	case !ok:
+	case !kept || len(after.banRule) == 0:
+		if s.lifts(before) {
+			s.list.lift(ip)
+		}
+	case after.banRule != before.banRule || after.banRef != before.banRef || !after.lastViewed.Equal(before.lastViewed):
+		s.push(ip, after)
+	}
+	return ok
+}
+
+func (s *sharedStore) Expire(now time.Time, banTime time.Duration) []string {
+	s.list.expire(now)
+	return s.Store.Expire(now, banTime)
+}
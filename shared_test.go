@@ -0,0 +1,140 @@
+package fail2ban
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newSharedTestServer(t *testing.T, ctx context.Context, list string, numberFails uint, banTime string) *fail2Ban {
+	config := CreateConfig()
+	config.LogLevel = "ERROR"
+	config.SharedList = list
+	config.NumberFails = numberFails
+	config.BanTime = banTime
+	return newTestServerContext(t, ctx, config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func TestSharedList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	list := uniqueName()
+	api := newSharedTestServer(t, ctx, list, 3, "1h")
+	web := newSharedTestServer(t, ctx, list, 10, "10m")
+	isolated := newSharedTestServer(t, ctx, "", 3, "1h")
+
+	for idx := 0; idx < 3; idx++ {
+		api.incrementViewCounter("1.1.1.1")
+		isolated.incrementViewCounter("3.3.3.3")
+	}
+	details := web.isClientBanned("1.1.1.1")
+	if details == nil || details.Reason != ruleFails {
+		t.Fatalf("Ban should have been shared, got %+v", details)
+	}
+	// the ban lasts as long as the instance which made it says
+	if remaining := time.Until(details.Expires); remaining < 50*time.Minute {
+		t.Errorf("Expected the shared ban to last about an hour but it expires in %s", remaining)
+	}
+	if isolated.isClientBanned("1.1.1.1") != nil {
+		t.Error("Instance without the shared list should not see the ban")
+	}
+	if web.isClientBanned("3.3.3.3") != nil {
+		t.Error("Bans from an instance without the shared list should not be shared")
+	}
+
+	// fail counters and thresholds stay with each instance
+	for idx := 0; idx < 4; idx++ {
+		web.incrementViewCounter("2.2.2.2")
+	}
+	if web.isClientBanned("2.2.2.2") != nil {
+		t.Error("4 failures should not reach the web threshold of 10")
+	}
+	if _, ok := api.inspectClient("2.2.2.2"); ok {
+		t.Error("Fail counters should not have been shared")
+	}
+
+	// lifting a ban early lifts it everywhere
+	web.clearBan("1.1.1.1", web.currentBanRef("1.1.1.1"))
+	if api.isClientBanned("1.1.1.1") != nil {
+		t.Error("Ban lifted on one instance should be lifted on the others")
+	}
+}
+
+func TestSharedListDropped(t *testing.T) {
+	list := uniqueName()
+	apiCtx, cancelAPI := context.WithCancel(context.TODO())
+	webCtx, cancelWeb := context.WithCancel(context.TODO())
+	defer cancelWeb()
+	newSharedTestServer(t, apiCtx, list, 3, "1h")
+	newSharedTestServer(t, webCtx, list, 3, "1h")
+	listed := func() bool {
+		sharedLists.mu.Lock()
+		defer sharedLists.mu.Unlock()
+		_, ok := sharedLists.lists[list]
+		return ok
+	}
+
+	cancelAPI()
+	time.Sleep(50 * time.Millisecond)
+	if !listed() {
+		t.Fatal("List should be kept while an instance uses it")
+	}
+	cancelWeb()
+	if !eventually(func() bool { return !listed() }) {
+		t.Error("List should have been dropped once no instance uses it")
+	}
+}
+
+func TestSharedListExpire(t *testing.T) {
+	list := &banList{bans: make(map[string]sharedBan)}
+	now := time.Now()
+	list.set("1.1.1.1", sharedBan{rule: ruleScanner, expires: now.Add(time.Hour)})
+	list.set("1.1.1.1", sharedBan{rule: ruleScanner, expires: now.Add(time.Minute)})
+	list.set("2.2.2.2", sharedBan{rule: ruleScanner, expires: now.Add(-time.Minute)})
+
+	if b, ok := list.get("1.1.1.1", now); !ok || !b.expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("Shared bans should never get shorter, got %+v", b)
+	}
+	if _, ok := list.get("2.2.2.2", now); ok {
+		t.Error("Expired ban should not be active")
+	}
+	list.expire(now)
+	if len(list.bans) != 1 {
+		t.Errorf("Expected 1 ban left after expiring but got %d", len(list.bans))
+	}
+}
+
+// Store whose reads of blocked wait until release is closed, like a slow
+// Redis round-trip
+type slowStore struct {
+	Store
+	blocked string
+	release chan struct{}
+}
+
+func (s *slowStore) Get(ip string) (client, bool) {
+	if ip == s.blocked {
+		<-s.release
+	}
+	return s.Store.Get(ip)
+}
+
+func TestSharedStoreLocksPerClient(t *testing.T) {
+	slow := &slowStore{Store: newMemoryStore(), blocked: "1.1.1.1", release: make(chan struct{})}
+	defer close(slow.release)
+	s := &sharedStore{Store: slow, list: &banList{bans: make(map[string]sharedBan)}, banTime: time.Hour}
+	go s.Get("1.1.1.1")
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		s.Get("2.2.2.2")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Waiting on one client should not hold up the others")
+	}
+}
@@ -0,0 +1,58 @@
+package fail2ban
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// Signs and verifies tokens handed out to clients
+type signer struct {
+	key []byte
+}
+
+// Create a signer from secret, a random key is used when secret is empty
+func newSigner(secret string) (*signer, error) {
+	if len(secret) != 0 {
+		return &signer{key: []byte(secret)}, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &signer{key: key}, nil
+}
+
+func (s *signer) mac(payload []byte) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// Token in the form <base64 payload>.<base64 signature>, safe to use in URLs and cookies
+func (s *signer) sign(payload []byte) string {
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+// Return the payload of the token if its signature is valid
+func (s *signer) verify(token string) ([]byte, bool) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, false
+	}
+	if !hmac.Equal(sig, s.mac(payload)) {
+		return nil, false
+	}
+	return bytes.Clone(payload), true
+}
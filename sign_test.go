@@ -0,0 +1,44 @@
+package fail2ban
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSigner(t *testing.T) {
+	s, err := newSigner("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := s.sign([]byte("payload"))
+	if strings.ContainsAny(token, "+/=") {
+		t.Errorf("Token should be URL safe, got %q", token)
+	}
+	if payload, ok := s.verify(token); !ok || string(payload) != "payload" {
+		t.Errorf("Expected valid token, got %q %t", payload, ok)
+	}
+
+	other, _ := newSigner("other")
+	tests := map[string]string{
+		"other key":     other.sign([]byte("payload")),
+		"tampered":      "cGF5bG9hZA." + strings.Split(s.sign([]byte("payloae")), ".")[1],
+		"no signature":  "cGF5bG9hZA",
+		"bad encoding":  "!!!." + strings.Split(token, ".")[1],
+		"bad signature": "cGF5bG9hZA.!!!",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := s.verify(token); ok {
+				t.Error("Token should not verify")
+			}
+		})
+	}
+}
+
+func TestRandomSigner(t *testing.T) {
+	a, _ := newSigner("")
+	b, _ := newSigner("")
+	if _, ok := b.verify(a.sign([]byte("payload"))); ok {
+		t.Error("Random keys should differ")
+	}
+}
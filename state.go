@@ -0,0 +1,192 @@
+package fail2ban
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// version of the state file format, files with other versions are ignored
+const stateVersion = 1
+
+// StateConfig keeps bans and fail counters across restarts in a file
+type StateConfig struct {
+	// File the state is saved to, empty disables saving state
+	File string
+	// Interval between snapshots, the state is also saved on shutdown
+	Interval string
+}
+
+type state struct {
+	file     string
+	interval time.Duration
+}
+
+func newState(config StateConfig) (*state, error) {
+	if len(config.File) == 0 {
+		return nil, nil
+	}
+	s := &state{file: config.File, interval: time.Minute}
+	if len(config.Interval) != 0 {
+		d, err := time.ParseDuration(config.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state interval: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("state interval must be positive, got %q", d)
+		}
+		s.interval = d
+	}
+	return s, nil
+}
+
+// Snapshot of every tracked client as written to the state file
+type stateSnapshot struct {
+	Version int                    `json:"version"`
+	Saved   time.Time              `json:"saved"`
+	Clients map[string]clientState `json:"clients"`
+}
+
+// Saved part of a client, detector windows are short lived and not kept
+type clientState struct {
+	LastViewed      time.Time `json:"lastViewed"`
+	FailCounter     uint      `json:"failCounter"`
+	BanRule         string    `json:"banRule,omitempty"`
+	BanRef          string    `json:"banRef,omitempty"`
+	ThrottledUntil  time.Time `json:"throttledUntil"`
+	TrustedUntil    time.Time `json:"trustedUntil"`
+	TrustedMaxFails uint      `json:"trustedMaxFails,omitempty"`
+	Matched         []string  `json:"matched,omitempty"`
+}
+
+func newClientState(c *client) clientState {
+	return clientState{
+		LastViewed:      c.lastViewed,
+		FailCounter:     c.failCounter,
+		BanRule:         c.banRule,
+		BanRef:          c.banRef,
+		ThrottledUntil:  c.throttledUntil,
+		TrustedUntil:    c.trustedUntil,
+		TrustedMaxFails: c.trustedMaxFails,
+		Matched:         c.matched,
+	}
+}
+
+func (s clientState) equal(o clientState) bool {
+	if len(s.Matched) != len(o.Matched) {
+		return false
+	}
+	for idx := range s.Matched {
+		if s.Matched[idx] != o.Matched[idx] {
+			return false
+		}
+	}
+	return s.LastViewed.Equal(o.LastViewed) &&
+		s.FailCounter == o.FailCounter &&
+		s.BanRule == o.BanRule &&
+		s.BanRef == o.BanRef &&
+		s.ThrottledUntil.Equal(o.ThrottledUntil) &&
+		s.TrustedUntil.Equal(o.TrustedUntil) &&
+		s.TrustedMaxFails == o.TrustedMaxFails
+}
+
+func (s clientState) client() *client {
+	return &client{
+		lastViewed:      s.LastViewed,
+		failCounter:     s.FailCounter,
+		banRule:         s.BanRule,
+		banRef:          s.BanRef,
+		throttledUntil:  s.ThrottledUntil,
+		trustedUntil:    s.TrustedUntil,
+		trustedMaxFails: s.TrustedMaxFails,
+		matched:         s.Matched,
+	}
+}
+
+// Write the state file, replacing it atomically so a crash part way
+// through never leaves a truncated file behind
+func (f *fail2Ban) saveState() {
+	if f.state == nil {
+		return
+	}
+	snapshot := stateSnapshot{Version: stateVersion, Saved: time.Now()}
+	snapshot.Clients = make(map[string]clientState, f.store.Len())
+	f.store.Range(func(ip string, c client) bool {
+		snapshot.Clients[ip] = newClientState(&c)
+		return true
+	})
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = writeFileAtomic(f.state.file, data)
+	}
+	if err != nil {
+		f.logger.Errorf("Failed to save state to %q: %s", f.state.file, err)
+		return
+	}
+	f.logger.Debugf("Saved %d clients to %q", len(snapshot.Clients), f.state.file)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore clients from the state file, dropping the ones which expired
+// while the middleware was not running. A missing or unreadable file
+// starts with no clients rather than stopping the middleware from loading.
+func (f *fail2Ban) loadState() {
+	if f.state == nil {
+		return
+	}
+	data, err := os.ReadFile(f.state.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		f.logger.Errorf("Failed to read state from %q: %s", f.state.file, err)
+		return
+	}
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		f.logger.Errorf("Failed to parse state from %q: %s", f.state.file, err)
+		return
+	}
+	if snapshot.Version != stateVersion {
+		f.logger.Warnf("Ignoring state in %q, version %d is not supported", f.state.file, snapshot.Version)
+		return
+	}
+
+	now := time.Now()
+	var dropped int
+	for ip, saved := range snapshot.Clients {
+		restored := saved.client()
+		if restored.hasBanExpired(now, f.banTime) {
+			dropped++
+			continue
+		}
+		f.store.Update(ip, true, func(c *client) bool {
+			*c = *restored
+			return true
+		})
+	}
+	f.logger.Infof("Restored %d clients from %q, dropped %d which expired", len(snapshot.Clients)-dropped, f.state.file, dropped)
+}
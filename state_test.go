@@ -0,0 +1,113 @@
+package fail2ban
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newStateTestServer(t *testing.T, ctx context.Context, file string) *fail2Ban {
+	f := newTestServerContext(
+		t,
+		ctx,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 3,
+			State:       StateConfig{File: file, Interval: "1h"},
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	return f
+}
+
+func TestStateRestored(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	// never cancelled, saving on shutdown would race the temp dir clean up
+	ctx := context.TODO()
+
+	f := newStateTestServer(t, ctx, file)
+	now := time.Now()
+	memory(f).mu.Lock()
+	memory(f).clients["1.1.1.1"] = &client{lastViewed: now, failCounter: 3, banRef: "abc"}
+	memory(f).clients["2.2.2.2"] = &client{lastViewed: now, failCounter: 1, banRule: ruleScanner, matched: []string{ruleScanner}}
+	memory(f).clients["3.3.3.3"] = &client{lastViewed: now.Add(-2 * time.Hour), failCounter: 5}
+	memory(f).mu.Unlock()
+	f.saveState()
+
+	restored := newStateTestServer(t, ctx, file)
+	if info, ok := restored.inspectClient("1.1.1.1"); !ok || !info.Banned || info.BanReference != "abc" || !info.LastViewed.Equal(now) {
+		t.Errorf("Expected 1.1.1.1 to still be banned, got %+v", info)
+	}
+	if info, ok := restored.inspectClient("2.2.2.2"); !ok || info.BanRule != ruleScanner || len(info.MatchedRules) != 1 {
+		t.Errorf("Expected 2.2.2.2 to still be banned for scanning, got %+v", info)
+	}
+	if _, ok := restored.inspectClient("3.3.3.3"); ok {
+		t.Error("Expired client should have been dropped")
+	}
+
+	// only the state file is left behind, temp files get renamed over it
+	entries, _ := os.ReadDir(filepath.Dir(file))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %v", entries)
+	}
+}
+
+func TestStateSavedOnShutdown(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	ctx, cancel := context.WithCancel(context.TODO())
+	f := newStateTestServer(t, ctx, file)
+	f.incrementViewCounter("1.1.1.1")
+	f.incrementViewCounter("1.1.1.1")
+	cancel()
+
+	for idx := 0; idx < 100; idx++ {
+		if _, err := os.Stat(file); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	restored := newStateTestServer(t, context.TODO(), file)
+	if info, ok := restored.inspectClient("1.1.1.1"); !ok || info.FailCounter != 2 {
+		t.Errorf("Expected fail counter to be restored, got %+v", info)
+	}
+}
+
+func TestStateUnreadable(t *testing.T) {
+	tests := map[string]string{
+		"corrupt":     `{"version":1,"clients":{`,
+		"old version": `{"version":0,"clients":{"1.1.1.1":{"lastViewed":"2100-01-01T00:00:00Z","failCounter":10}}}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "state.json")
+			os.WriteFile(file, []byte(content), 0o600)
+			f := newStateTestServer(t, context.TODO(), file)
+			if tracked := f.snapshotStats().TrackedClients; tracked != 0 {
+				t.Errorf("Expected no clients but got %d", tracked)
+			}
+		})
+	}
+}
+
+func TestStateConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  StateConfig
+		isError bool
+	}{
+		"disabled":         {StateConfig{Interval: "garbage"}, false},
+		"default interval": {StateConfig{File: "state.json"}, false},
+		"bad interval":     {StateConfig{File: "state.json", Interval: "garbage"}, true},
+		"zero interval":    {StateConfig{File: "state.json", Interval: "0s"}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newState(test.config); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
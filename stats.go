@@ -0,0 +1,189 @@
+package fail2ban
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsConfig serves the stats and the state of tracked clients as JSON
+type StatsConfig struct {
+	// Path the stats are served on, a tracked client is inspected with
+	// ?client=<ip> and a redirect reference token with ?token=<token>.
+	// Empty disables the endpoint.
+	Path string
+	// Token requests have to send as "Authorization: Bearer <token>"
+	Token string
+}
+
+type event string
+
+const (
+	eventBan      event = "ban"
+	eventUnban    event = "unban"
+	eventBlocked  event = "blocked"
+	eventThrottle event = "throttle"
+	eventSuccess  event = "success"
+	eventDelay    event = "delay"
+	eventReject   event = "reject"
+	eventTarpit   event = "tarpit"
+	eventDrop     event = "drop"
+	// challenges handed out to banned clients and solved by them
+	eventChallenge       event = "challenge"
+	eventChallengePassed event = "challenge_passed"
+	// bans and throttling monitored rules would have done
+	eventWouldBan      event = "would_ban"
+	eventWouldThrottle event = "would_throttle"
+	// events sent to and applied from peers, dropped from full queues and
+	// messages rejected for a bad signature or age
+	eventGossipSent     event = "gossip_sent"
+	eventGossipReceived event = "gossip_received"
+	eventGossipDropped  event = "gossip_dropped"
+	eventGossipRejected event = "gossip_rejected"
+	// clients evicted to stay within MaxTrackedClients, and new clients not
+	// tracked because only bans were left to evict
+	eventEvicted    event = "evicted"
+	eventEvictedBan event = "evicted_ban"
+	eventShed       event = "shed"
+)
+
+// counters for things the middleware has done
+type stats struct {
+	mu     sync.Mutex
+	events map[event]uint64
+	bytes  uint64
+}
+
+func newStats() *stats {
+	return &stats{events: make(map[event]uint64)}
+}
+
+func (s *stats) record(e event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[e]++
+}
+
+func (s *stats) addBytes(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += n
+}
+
+type statsSnapshot struct {
+	Events         map[event]uint64 `json:"events"`
+	Bytes          uint64           `json:"bytes"`
+	TrackedClients int              `json:"trackedClients"`
+}
+
+func (f *fail2Ban) snapshotStats() statsSnapshot {
+	tracked := f.store.Len()
+
+	f.stats.mu.Lock()
+	defer f.stats.mu.Unlock()
+	events := make(map[event]uint64, len(f.stats.events))
+	for e, n := range f.stats.events {
+		events[e] = n
+	}
+	return statsSnapshot{
+		Events:         events,
+		Bytes:          f.stats.bytes,
+		TrackedClients: tracked,
+	}
+}
+
+// point in time view of a tracked client
+type clientInfo struct {
+	IP             string    `json:"ip"`
+	FailCounter    uint      `json:"failCounter"`
+	LastViewed     time.Time `json:"lastViewed"`
+	Banned         bool      `json:"banned"`
+	BanRule        string    `json:"banRule,omitempty"`
+	BanReference   string    `json:"banReference,omitempty"`
+	BytesInWindow  uint64    `json:"bytesInWindow"`
+	BytesTotal     uint64    `json:"bytesTotal"`
+	ThrottledUntil time.Time `json:"throttledUntil"`
+	FailedPaths    int       `json:"failedPaths"`
+	TrustedUntil   time.Time `json:"trustedUntil"`
+	MatchedRules   []string  `json:"matchedRules,omitempty"`
+}
+
+func (f *fail2Ban) inspectClient(ip string) (clientInfo, bool) {
+	c, ok := f.store.Get(ip)
+	if !ok {
+		return clientInfo{}, false
+	}
+	return newClientInfo(ip, &c, f.maxFails), true
+}
+
+func newClientInfo(ip string, c *client, maxFails uint) clientInfo {
+	info := clientInfo{
+		IP:             ip,
+		FailCounter:    c.failCounter,
+		LastViewed:     c.lastViewed,
+		Banned:         c.isBanned(maxFails),
+		BytesInWindow:  c.bandwidth.bytes,
+		BytesTotal:     c.bandwidth.total,
+		ThrottledUntil: c.throttledUntil,
+		FailedPaths:    len(c.paths.hashes),
+		TrustedUntil:   c.trustedUntil,
+		MatchedRules:   append([]string(nil), c.matched...),
+	}
+	if info.Banned {
+		info.BanRule = c.rule()
+		info.BanReference = c.banRef
+	}
+	return info
+}
+
+type statsServer struct {
+	path  string
+	token string
+}
+
+func newStatsServer(config StatsConfig) (*statsServer, error) {
+	if len(config.Path) == 0 {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		return nil, fmt.Errorf("invalid stats path %q, must start with /", config.Path)
+	}
+	if len(config.Token) == 0 {
+		return nil, errors.New("stats endpoint needs a token")
+	}
+	return &statsServer{path: config.Path, token: config.Token}, nil
+}
+
+// Answer with the stats, or the state of the client asked for
+func (f *fail2Ban) serveStats(rw http.ResponseWriter, req *http.Request) {
+	auth := []byte(req.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+f.statsServer.token)) != 1 {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var body any = f.snapshotStats()
+	if ip := req.URL.Query().Get("client"); len(ip) != 0 {
+		info, ok := f.inspectClient(ip)
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body = info
+	} else if token := req.URL.Query().Get("token"); len(token) != 0 {
+		lookup, ok := f.lookupToken(token)
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body = lookup
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,100 @@
+package fail2ban
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsConfig(t *testing.T) {
+	tests := map[string]struct {
+		config StatsConfig
+		err    bool
+	}{
+		"Should be disabled without a path": {config: StatsConfig{}},
+		"Should accept a path and token":    {config: StatsConfig{Path: "/.fail2ban/stats", Token: "secret"}},
+		"Should reject a relative path":     {config: StatsConfig{Path: "stats", Token: "secret"}, err: true},
+		"Should reject a missing token":     {config: StatsConfig{Path: "/.fail2ban/stats"}, err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := newStatsServer(test.config)
+			if (err != nil) != test.err {
+				t.Errorf("Expected error to be %t but got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	next := 0
+	f := newTestServer(t, &Config{
+		BanTime:      "1h",
+		LogLevel:     "ERROR",
+		NumberFails:  2,
+		ClientHeader: "client",
+		Stats:        StatsConfig{Path: "/.fail2ban/stats", Token: "secret"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next++
+	}))
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 2}
+	f.stats.record(eventBan)
+
+	tests := map[string]struct {
+		target string
+		token  string
+		code   int
+	}{
+		"Should reject requests without the token":  {target: "/.fail2ban/stats", code: http.StatusUnauthorized},
+		"Should reject requests with another token": {target: "/.fail2ban/stats", token: "other", code: http.StatusUnauthorized},
+		"Should serve the stats":                    {target: "/.fail2ban/stats", token: "secret", code: http.StatusOK},
+		"Should serve a tracked client":             {target: "/.fail2ban/stats?client=1.2.3.4", token: "secret", code: http.StatusOK},
+		"Should not find an unknown client":         {target: "/.fail2ban/stats?client=5.6.7.8", token: "secret", code: http.StatusNotFound},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://garbage"+test.target, nil)
+			request.Header.Set("client", "9.9.9.9")
+			if len(test.token) != 0 {
+				request.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			response := httptest.NewRecorder()
+			f.ServeHTTP(response, request)
+			if response.Code != test.code {
+				t.Errorf("Expected response to be %d but got %d", test.code, response.Code)
+			}
+		})
+	}
+	if next != 0 {
+		t.Errorf("Expected stats requests not to be forwarded but got %d", next)
+	}
+	if _, ok := f.inspectClient("5.6.7.8"); ok {
+		t.Errorf("Expected inspecting an unknown client not to track it")
+	}
+
+	request := httptest.NewRequest("GET", "http://garbage/.fail2ban/stats", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response := httptest.NewRecorder()
+	f.ServeHTTP(response, request)
+	var stats statsSnapshot
+	if err := json.NewDecoder(response.Body).Decode(&stats); err != nil {
+		t.Fatalf("Expected stats to be JSON but got %v", err)
+	}
+	if stats.Events[eventBan] != 1 || stats.TrackedClients != 1 {
+		t.Errorf("Expected 1 ban and 1 tracked client but got %+v", stats)
+	}
+
+	request = httptest.NewRequest("GET", "http://garbage/.fail2ban/stats?client=1.2.3.4", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	f.ServeHTTP(response, request)
+	var info clientInfo
+	if err := json.NewDecoder(response.Body).Decode(&info); err != nil {
+		t.Fatalf("Expected client to be JSON but got %v", err)
+	}
+	if info.IP != "1.2.3.4" || info.FailCounter != 2 || !info.Banned {
+		t.Errorf("Expected banned client 1.2.3.4 with 2 failures but got %+v", info)
+	}
+}
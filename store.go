@@ -0,0 +1,202 @@
+package fail2ban
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// number of locks clientLocks spreads clients over
+const clientLockStripes = 64
+
+// Store keeps the state of every tracked client. Implementations must be
+// safe for concurrent use.
+type Store interface {
+	// Get a copy of the client, maps in it are shared so use Update to read them
+	Get(ip string) (client, bool)
+	// RecordFailure adds a failure to the client, returning the client after
+	// the update and whether this was its first failure
+	RecordFailure(ip string, now time.Time) (c client, created bool)
+	// Ban the client for rule, starting its ban at now
+	Ban(ip string, rule string, now time.Time)
+	// Unban forgets the client, returning false if it wasn't tracked
+	Unban(ip string) bool
+	// Update runs fn on the client while no one else can change it, creating
+	// the client first if create is set. The client is forgotten when fn
+	// returns false. Returns false when there was no client to update.
+	Update(ip string, create bool, fn func(c *client) bool) bool
+	// Range calls fn with a copy of each client until fn returns false
+	Range(fn func(ip string, c client) bool)
+	// Expire forgets clients which haven't been seen for banTime, returning their IPs
+	Expire(now time.Time, banTime time.Duration) []string
+	// Len is the number of tracked clients
+	Len() int
+}
+
+// Locks serializing changes to the same client across several store calls,
+// without serializing changes to every client
+type clientLocks [clientLockStripes]sync.Mutex
+
+// Lock changes to the client, returns the function unlocking it
+func (l *clientLocks) lock(ip string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	m := &l[h.Sum32()%clientLockStripes]
+	m.Lock()
+	return m.Unlock
+}
+
+// Lock changes to every client, eg while compacting
+func (l *clientLocks) lockAll() func() {
+	for idx := range l {
+		l[idx].Lock()
+	}
+	return func() {
+		for idx := range l {
+			l[idx].Unlock()
+		}
+	}
+}
+
+// Store keeping clients in a map, the default
+type memoryStore struct {
+	mu      sync.Mutex
+	clients map[string]*client
+	// eviction order when the number of clients is capped, nil otherwise
+	lru *clientLRU
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{clients: make(map[string]*client)}
+}
+
+// Start tracking a new client, returning false when it got shed because
+// the cap is taken up by bans
+func (s *memoryStore) add(ip string, c *client, ban bool) bool {
+	if s.lru != nil {
+		evicted, ok := s.lru.admit(len(s.clients), ban)
+		if !ok {
+			return false
+		}
+		if len(evicted) != 0 {
+			delete(s.clients, evicted)
+		}
+	}
+	s.clients[ip] = c
+	s.seen(ip, c)
+	return true
+}
+
+func (s *memoryStore) seen(ip string, c *client) {
+	if s.lru != nil {
+		s.lru.touch(ip, c)
+	}
+}
+
+func (s *memoryStore) forget(ip string) {
+	delete(s.clients, ip)
+	if s.lru != nil {
+		s.lru.remove(ip)
+	}
+}
+
+func (s *memoryStore) Get(ip string) (client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[ip]
+	if !ok {
+		return client{}, false
+	}
+	s.seen(ip, c)
+	return *c, true
+}
+
+func (s *memoryStore) RecordFailure(ip string, now time.Time) (client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[ip]
+	if !ok {
+		// the first failure doesn't start the ban clock
+		c = &client{failCounter: 1}
+		s.add(ip, c, false)
+		return *c, true
+	}
+	c.lastViewed = now
+	c.failCounter++
+	s.seen(ip, c)
+	return *c, false
+}
+
+func (s *memoryStore) Ban(ip string, rule string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[ip]
+	if !ok {
+		c = &client{}
+		if !s.add(ip, c, true) {
+			return
+		}
+	}
+	c.banRule = rule
+	c.lastViewed = now
+	c.match(rule)
+	s.seen(ip, c)
+}
+
+func (s *memoryStore) Unban(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.clients[ip]
+	s.forget(ip)
+	return ok
+}
+
+func (s *memoryStore) Update(ip string, create bool, fn func(c *client) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[ip]
+	if !ok {
+		if !create {
+			return false
+		}
+		c = &client{lastViewed: time.Now()}
+		if !s.add(ip, c, false) {
+			return false
+		}
+	}
+	if fn(c) {
+		s.seen(ip, c)
+	} else {
+		s.forget(ip)
+	}
+	return true
+}
+
+func (s *memoryStore) Range(fn func(ip string, c client) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, c := range s.clients {
+		if !fn(ip, *c) {
+			return
+		}
+	}
+}
+
+func (s *memoryStore) Expire(now time.Time, banTime time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []string
+	for ip, c := range s.clients {
+		if c.hasBanExpired(now, banTime) {
+			expired = append(expired, ip)
+			s.forget(ip)
+		}
+	}
+	return expired
+}
+
+func (s *memoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
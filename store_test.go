@@ -0,0 +1,65 @@
+package fail2ban
+
+import (
+	"testing"
+	"time"
+)
+
+// The in-memory store under any decorators, for tests which poke at clients directly
+func memory(f *fail2Ban) *memoryStore {
+	store := f.store
+	for {
+		switch s := store.(type) {
+		case *journalStore:
+			store = s.Store
+		case *sharedStore:
+			store = s.Store
+		case *gossipStore:
+			store = s.Store
+		case *redisStore:
+			return s.local
+		default:
+			return store.(*memoryStore)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore()
+	now := time.Now()
+
+	if c, created := s.RecordFailure("1.1.1.1", now); !created || c.failCounter != 1 || !c.lastViewed.IsZero() {
+		t.Errorf("First failure should create the client without starting the ban clock, got %+v", c)
+	}
+	if c, created := s.RecordFailure("1.1.1.1", now); created || c.failCounter != 2 || !c.lastViewed.Equal(now) {
+		t.Errorf("Second failure should update the client, got %+v", c)
+	}
+
+	s.Ban("2.2.2.2", ruleScanner, now)
+	if c, ok := s.Get("2.2.2.2"); !ok || !c.isBanned(10) || c.rule() != ruleScanner || len(c.matched) != 1 {
+		t.Errorf("Client should be banned for scanning, got %+v", c)
+	}
+
+	if s.Update("3.3.3.3", false, func(c *client) bool { return true }) {
+		t.Error("Update without create should not create clients")
+	}
+	s.Update("3.3.3.3", true, func(c *client) bool {
+		c.lastViewed = now.Add(-time.Hour)
+		return true
+	})
+	if s.Len() != 3 {
+		t.Errorf("Expected 3 clients but got %d", s.Len())
+	}
+
+	if expired := s.Expire(now, time.Minute); len(expired) != 1 || expired[0] != "3.3.3.3" {
+		t.Errorf("Expected only 3.3.3.3 to expire, got %v", expired)
+	}
+	s.Update("1.1.1.1", false, func(c *client) bool { return false })
+	if !s.Unban("2.2.2.2") || s.Unban("2.2.2.2") {
+		t.Error("Unban should report whether the client was tracked")
+	}
+	s.Range(func(ip string, c client) bool {
+		t.Errorf("Expected no clients, got %s", ip)
+		return true
+	})
+}
@@ -0,0 +1,155 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	successActionReset  = "reset"
+	successActionReduce = "reduce"
+	successActionTrust  = "trust"
+)
+
+// SuccessRule lowers a client's fail counter when a response shows it is a
+// legitimate user, eg a successful login
+type SuccessRule struct {
+	// Path prefix the request must match, empty matches every path
+	Path string
+	// Method the request must use, empty matches every method
+	Method string
+	// StatusCodes the response must have, empty matches any 2xx status code
+	StatusCodes []int
+	// Header the response must have, empty skips the check
+	Header string
+	// HeaderValue the Header must have, empty matches any value
+	HeaderValue string
+	// Action is one of "reset", "reduce" or "trust"
+	Action string
+	// Amount to reduce the fail counter by, defaults to 1
+	Amount uint
+	// TrustDuration is how long the client is trusted for
+	TrustDuration string
+	// TrustedNumberFails replaces NumberFails while the client is trusted
+	TrustedNumberFails uint
+}
+
+type successRule struct {
+	SuccessRule
+	trustDuration time.Duration
+}
+
+func newSuccessRules(rules []SuccessRule) ([]successRule, error) {
+	parsed := make([]successRule, 0, len(rules))
+	for idx, rule := range rules {
+		r := successRule{SuccessRule: rule}
+		r.Action = strings.ToLower(r.Action)
+		switch r.Action {
+		case successActionReset:
+		case successActionReduce:
+			if r.Amount == 0 {
+				r.Amount = 1
+			}
+		case successActionTrust:
+			d, err := time.ParseDuration(rule.TrustDuration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trust duration for success rule %d: %w", idx, err)
+			}
+			if rule.TrustedNumberFails == 0 {
+				return nil, fmt.Errorf("success rule %d needs TrustedNumberFails to trust clients", idx)
+			}
+			r.trustDuration = d
+		default:
+			return nil, fmt.Errorf("invalid action %q for success rule %d", rule.Action, idx)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// Check if the rule applies to the request and its response
+func (r successRule) matches(req *http.Request, code int, header http.Header) bool {
+	if len(r.Method) != 0 && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, r.Path) {
+		return false
+	}
+	if len(r.StatusCodes) == 0 {
+		if code < http.StatusOK || code >= http.StatusMultipleChoices {
+			return false
+		}
+	} else if !containsCode(r.StatusCodes, code) {
+		return false
+	}
+	if len(r.Header) != 0 {
+		values := header.Values(r.Header)
+		if len(values) == 0 {
+			return false
+		}
+		if len(r.HeaderValue) != 0 && !containsValue(values, r.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the first matching success rule to the client
+func (f *fail2Ban) applySuccessRules(ip string, req *http.Request, i *interceptor) {
+	var rule *successRule
+	for idx := range f.successRules {
+		if f.successRules[idx].matches(req, i.code, i.Header()) {
+			rule = &f.successRules[idx]
+			break
+		}
+	}
+	if rule == nil {
+		return
+	}
+
+	// only trusting a client is worth tracking it for
+	f.store.Update(ip, rule.Action == successActionTrust, func(c *client) bool {
+		f.applySuccessRule(ip, req, rule, c)
+		return true
+	})
+}
+
+func (f *fail2Ban) applySuccessRule(ip string, req *http.Request, rule *successRule, c *client) {
+	f.stats.record(eventSuccess)
+	switch rule.Action {
+	case successActionReset:
+		f.logger.Debugf("Reset fail counter for %s after success on %q", ip, req.URL.Path)
+		c.failCounter = 0
+	case successActionReduce:
+		f.logger.Debugf("Reduce fail counter for %s by %d after success on %q", ip, rule.Amount, req.URL.Path)
+		if c.failCounter > rule.Amount {
+			c.failCounter -= rule.Amount
+		} else {
+			c.failCounter = 0
+		}
+	case successActionTrust:
+		f.logger.Infof("Trusting %s for %q after success on %q", ip, rule.trustDuration, req.URL.Path)
+		c.trustedUntil = time.Now().Add(rule.trustDuration)
+		c.trustedMaxFails = rule.TrustedNumberFails
+	}
+}
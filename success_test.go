@@ -0,0 +1,156 @@
+package fail2ban
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSuccessTestServer(t *testing.T, rules []SuccessRule) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:      "1h",
+			LogLevel:     "ERROR",
+			NumberFails:  3,
+			SuccessRules: rules,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/login":
+				if r.Header.Get("password") != "correct" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("X-Auth", "ok")
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+		}),
+	)
+	return f
+}
+
+func login(f *fail2Ban, method string, password string) int {
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest(method, "http://garbage/login", nil)
+	request.RemoteAddr = "1.2.3.4:5678"
+	request.Header.Set("password", password)
+	f.ServeHTTP(response, request)
+	return response.Code
+}
+
+func TestSuccessRuleReset(t *testing.T) {
+	f := newSuccessTestServer(t, []SuccessRule{{
+		Path:   "/login",
+		Method: "POST",
+		Action: "reset",
+	}})
+
+	login(f, "POST", "typo")
+	login(f, "POST", "typo")
+	// wrong method does not match
+	login(f, "GET", "correct")
+	if info, _ := f.inspectClient("1.2.3.4"); info.FailCounter != 2 {
+		t.Errorf("Expected fail counter 2, got %d", info.FailCounter)
+	}
+	login(f, "POST", "correct")
+	if info, _ := f.inspectClient("1.2.3.4"); info.FailCounter != 0 {
+		t.Errorf("Expected fail counter to be reset, got %d", info.FailCounter)
+	}
+	login(f, "POST", "typo")
+	login(f, "POST", "typo")
+	if code := login(f, "POST", "correct"); code != http.StatusOK {
+		t.Errorf("Client should not be banned, got %d", code)
+	}
+}
+
+func TestSuccessRuleReduce(t *testing.T) {
+	f := newSuccessTestServer(t, []SuccessRule{{
+		Header:      "X-Auth",
+		HeaderValue: "ok",
+		Action:      "reduce",
+	}})
+
+	login(f, "POST", "typo")
+	login(f, "POST", "typo")
+	login(f, "POST", "correct")
+	if info, _ := f.inspectClient("1.2.3.4"); info.FailCounter != 1 {
+		t.Errorf("Expected fail counter 1, got %d", info.FailCounter)
+	}
+	login(f, "POST", "correct")
+	login(f, "POST", "correct")
+	if info, _ := f.inspectClient("1.2.3.4"); info.FailCounter != 0 {
+		t.Errorf("Fail counter should not go below 0, got %d", info.FailCounter)
+	}
+}
+
+func TestSuccessRuleTrust(t *testing.T) {
+	f := newSuccessTestServer(t, []SuccessRule{{
+		Path:               "/login",
+		Action:             "trust",
+		TrustDuration:      "1h",
+		TrustedNumberFails: 10,
+	}})
+
+	login(f, "POST", "correct")
+	if info, _ := f.inspectClient("1.2.3.4"); info.TrustedUntil.IsZero() {
+		t.Error("Client should be trusted")
+	}
+	for idx := 0; idx < 10; idx++ {
+		if code := login(f, "POST", "typo"); code != http.StatusUnauthorized {
+			t.Errorf("Trusted client should not be banned on request %d, got %d", idx, code)
+		}
+	}
+	if code := login(f, "POST", "typo"); code != http.StatusForbidden {
+		t.Errorf("Trusted client should be banned after 10 fails, got %d", code)
+	}
+}
+
+func TestSuccessRuleTrustExpired(t *testing.T) {
+	f := newSuccessTestServer(t, []SuccessRule{{
+		Path:               "/login",
+		Action:             "trust",
+		TrustDuration:      "1h",
+		TrustedNumberFails: 10,
+	}})
+
+	login(f, "POST", "correct")
+	for idx := 0; idx < 5; idx++ {
+		login(f, "POST", "typo")
+	}
+	f.store.Update("1.2.3.4", false, func(c *client) bool {
+		c.trustedUntil = time.Now().Add(-time.Second)
+		return true
+	})
+	if code := login(f, "POST", "correct"); code != http.StatusForbidden {
+		t.Errorf("Client past NumberFails should be banned once trust expired, got %d", code)
+	}
+	if info, _ := f.inspectClient("1.2.3.4"); info.BanRule != ruleFails {
+		t.Errorf("Expected ban by %q but got %+v", ruleFails, info)
+	}
+}
+
+func TestSuccessRuleConfig(t *testing.T) {
+	tests := map[string]struct {
+		rule    SuccessRule
+		isError bool
+	}{
+		"reset":          {SuccessRule{Action: "reset"}, false},
+		"reduce":         {SuccessRule{Action: "Reduce"}, false},
+		"trust":          {SuccessRule{Action: "trust", TrustDuration: "1h", TrustedNumberFails: 5}, false},
+		"trust no fails": {SuccessRule{Action: "trust", TrustDuration: "1h"}, true},
+		"trust bad time": {SuccessRule{Action: "trust", TrustedNumberFails: 5}, true},
+		"unknown action": {SuccessRule{Action: "garbage"}, true},
+		"no action":      {SuccessRule{}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newSuccessRules([]SuccessRule{test.rule}); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	tarpitThenRespond = "respond"
+	tarpitThenDrop    = "drop"
+)
+
+// TarpitConfig holds requests from banned clients open before answering them
+type TarpitConfig struct {
+	Duration string
+	// TrickleInterval between bytes sent while holding the request, 0 sends nothing
+	TrickleInterval string
+	// MaxConcurrent requests held at once, further requests are answered straight away
+	MaxConcurrent uint
+	// Then is either "respond" to send the ban response or "drop" to close the connection
+	Then string
+}
+
+type tarpit struct {
+	duration time.Duration
+	trickle  time.Duration
+	drop     bool
+	slots    chan struct{}
+}
+
+func newTarpit(config TarpitConfig) (*tarpit, error) {
+	t := &tarpit{duration: 30 * time.Second}
+	err := parseDurations("tarpit",
+		durationOption{"duration", config.Duration, &t.duration},
+		durationOption{"trickle interval", config.TrickleInterval, &t.trickle},
+	)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(config.Then) {
+	case "", tarpitThenRespond:
+	case tarpitThenDrop:
+		t.drop = true
+	default:
+		return nil, fmt.Errorf("invalid tarpit then %q", config.Then)
+	}
+	maxConcurrent := config.MaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = 100
+	}
+	t.slots = make(chan struct{}, maxConcurrent)
+	return t, nil
+}
+
+// Take a slot to hold a request in, false when all slots are in use
+func (t *tarpit) acquire() bool {
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *tarpit) release() {
+	<-t.slots
+}
+
+// Hold the request open, trickling bytes if configured. Returns false if the
+// client went away, or the response was started by trickling bytes.
+func (t *tarpit) hold(rw http.ResponseWriter, req *http.Request, statusCode int) bool {
+	if t.trickle <= 0 {
+		return sleep(req.Context(), t.duration)
+	}
+	rc := http.NewResponseController(rw)
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(statusCode)
+	deadline := time.Now().Add(t.duration)
+	for time.Now().Before(deadline) {
+		if _, err := rw.Write([]byte(" ")); err != nil {
+			return false
+		}
+		if err := rc.Flush(); err != nil {
+			return false
+		}
+		wait := time.Until(deadline)
+		if wait > t.trickle {
+			wait = t.trickle
+		}
+		if !sleep(req.Context(), wait) {
+			return false
+		}
+	}
+	return false
+}
+
+// Hold a request from a banned client before answering it
+func (f *fail2Ban) writeTarpit(rw http.ResponseWriter, req *http.Request, ban banDetails) error {
+	if !f.tarpit.acquire() {
+		f.logger.Debugf("Tarpit full, answering %s straight away", ban.IP)
+		return f.banResponse.write(rw, req, ban)
+	}
+	defer f.tarpit.release()
+	f.logger.Debugf("Tarpitting %s for %q", ban.IP, f.tarpit.duration)
+	f.stats.record(eventTarpit)
+
+	completed := f.tarpit.hold(rw, req, f.banResponse.statusCode)
+	if f.tarpit.drop {
+		if !f.dropConnection(rw) {
+			// stops the server from finishing the response, which resets
+			// the stream for connections that can't be taken over
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	}
+	if !completed {
+		return nil
+	}
+	return f.banResponse.write(rw, req, ban)
+}
@@ -0,0 +1,149 @@
+package fail2ban
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTarpitTestServer(t *testing.T, config TarpitConfig) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:      "1h",
+			LogLevel:     "ERROR",
+			NumberFails:  2,
+			ClientHeader: "client",
+			BanAction:    "tarpit",
+			Tarpit:       config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 2}
+	return f
+}
+
+func newTarpitRequest(ctx context.Context) *http.Request {
+	request := httptest.NewRequest("GET", "http://garbage", nil).WithContext(ctx)
+	request.Header.Set("client", "1.2.3.4")
+	return request
+}
+
+func TestTarpitHolds(t *testing.T) {
+	f := newTarpitTestServer(t, TarpitConfig{Duration: "50ms"})
+
+	response := httptest.NewRecorder()
+	start := time.Now()
+	f.ServeHTTP(response, newTarpitRequest(context.TODO()))
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("Request should be held for 50ms, took %s", took)
+	}
+	if response.Code != http.StatusForbidden {
+		t.Errorf("Expected response to be %d but got %d", http.StatusForbidden, response.Code)
+	}
+	if stats := f.snapshotStats(); stats.Events[eventTarpit] != 1 {
+		t.Errorf("Expected 1 tarpit event, got %d", stats.Events[eventTarpit])
+	}
+}
+
+func TestTarpitCancelled(t *testing.T) {
+	f := newTarpitTestServer(t, TarpitConfig{Duration: "1h"})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	response := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		f.ServeHTTP(response, newTarpitRequest(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Tarpit should stop when the request is cancelled")
+	}
+	if response.Body.Len() != 0 {
+		t.Error("Nothing should be written to a cancelled request")
+	}
+	if len(f.tarpit.slots) != 0 {
+		t.Error("Tarpit slot should be released")
+	}
+}
+
+func TestTarpitMaxConcurrent(t *testing.T) {
+	f := newTarpitTestServer(t, TarpitConfig{Duration: "1h", MaxConcurrent: 1})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go f.ServeHTTP(httptest.NewRecorder(), newTarpitRequest(ctx))
+	for len(f.tarpit.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	response := httptest.NewRecorder()
+	start := time.Now()
+	f.ServeHTTP(response, newTarpitRequest(context.TODO()))
+	if time.Since(start) > time.Second || response.Code != http.StatusForbidden {
+		t.Errorf("Request over the limit should be answered straight away, got %d", response.Code)
+	}
+}
+
+func TestTarpitTrickle(t *testing.T) {
+	f := newTarpitTestServer(t, TarpitConfig{Duration: "50ms", TrickleInterval: "10ms"})
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("client", "1.2.3.4")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected response to be %d but got %d", http.StatusForbidden, response.StatusCode)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if len(body) < 3 || strings.TrimSpace(string(body)) != "" {
+		t.Errorf("Expected some trickled spaces, got %q", body)
+	}
+}
+
+func TestTarpitDrop(t *testing.T) {
+	f := newTarpitTestServer(t, TarpitConfig{Duration: "10ms", Then: "drop"})
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("client", "1.2.3.4")
+	if response, err := http.DefaultClient.Do(request); err == nil {
+		response.Body.Close()
+		t.Errorf("Connection should be dropped, got %d", response.StatusCode)
+	}
+}
+
+func TestTarpitConfig(t *testing.T) {
+	tests := map[string]struct {
+		config  TarpitConfig
+		isError bool
+	}{
+		"defaults":     {TarpitConfig{}, false},
+		"drop":         {TarpitConfig{Then: "DROP"}, false},
+		"bad then":     {TarpitConfig{Then: "garbage"}, true},
+		"bad duration": {TarpitConfig{Duration: "garbage"}, true},
+		"bad trickle":  {TarpitConfig{TrickleInterval: "garbage"}, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newTarpit(test.config); (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package fail2ban
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ThrottleConfig escalates clients towards a ban instead of going straight
+// from full service to a ban once NumberFails is reached
+type ThrottleConfig struct {
+	// DelayAfter this many failures requests get delayed, 0 disables delaying
+	DelayAfter uint
+	// Delay added for every failure from DelayAfter onwards
+	Delay    string
+	MaxDelay string
+	// RejectAfter this many failures requests get a 429 response, 0 disables rejecting
+	RejectAfter uint
+	// RetryAfter sent with 429 responses
+	RetryAfter string
+}
+
+type throttle struct {
+	delayAfter  uint
+	delay       time.Duration
+	maxDelay    time.Duration
+	rejectAfter uint
+	retryAfter  time.Duration
+}
+
+func newThrottle(config ThrottleConfig, maxFails uint) (*throttle, error) {
+	if config.DelayAfter == 0 && config.RejectAfter == 0 {
+		return nil, nil
+	}
+	t := &throttle{
+		delayAfter:  config.DelayAfter,
+		delay:       500 * time.Millisecond,
+		maxDelay:    10 * time.Second,
+		rejectAfter: config.RejectAfter,
+		retryAfter:  time.Minute,
+	}
+	err := parseDurations("throttle",
+		durationOption{"delay", config.Delay, &t.delay},
+		durationOption{"max delay", config.MaxDelay, &t.maxDelay},
+		durationOption{"retry after", config.RetryAfter, &t.retryAfter},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if t.rejectAfter != 0 && t.delayAfter >= t.rejectAfter {
+		return nil, fmt.Errorf("throttle DelayAfter %d must be lower than RejectAfter %d", t.delayAfter, t.rejectAfter)
+	}
+	if t.rejectAfter >= maxFails || t.delayAfter >= maxFails {
+		return nil, fmt.Errorf("throttle steps must be lower than NumberFails %d", maxFails)
+	}
+	return t, nil
+}
+
+// Work out how a client with failCounter failures should be slowed down
+func (t *throttle) step(failCounter uint) (delay time.Duration, reject bool) {
+	if t.rejectAfter != 0 && failCounter >= t.rejectAfter {
+		return 0, true
+	}
+	if t.delayAfter == 0 || failCounter < t.delayAfter {
+		return 0, false
+	}
+	delay = time.Duration(failCounter-t.delayAfter+1) * t.delay
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	return delay, false
+}
+
+// Wait for d unless ctx gets cancelled first, returns false if cancelled
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (f *fail2Ban) throttleStep(ip string) (time.Duration, bool) {
+	if f.throttle == nil {
+		return 0, false
+	}
+	c, ok := f.store.Get(ip)
+	var failCounter uint
+	// trusted clients are allowed more failures so skip the ladder
+	if ok && c.threshold(f.maxFails) == f.maxFails {
+		failCounter = c.failCounter
+	}
+
+	delay, reject := f.throttle.step(failCounter)
+	if f.monitor[ruleFails] {
+		if reject || delay > 0 {
+			f.logger.Debugf("Would slow down %s after %d failures, %q is in monitor mode", ip, failCounter, ruleFails)
+		}
+		return 0, false
+	}
+	if reject {
+		f.logger.Infof("Rejecting %s after %d failures", ip, failCounter)
+		f.stats.record(eventReject)
+	} else if delay > 0 {
+		f.logger.Infof("Delaying %s by %q after %d failures", ip, delay, failCounter)
+		f.stats.record(eventDelay)
+	}
+	return delay, reject
+}
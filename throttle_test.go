@@ -0,0 +1,167 @@
+package fail2ban
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newThrottleTestServer(t *testing.T, config ThrottleConfig, calls *int32) *fail2Ban {
+	f := newTestServer(
+		t,
+		&Config{
+			BanTime:     "1h",
+			LogLevel:    "ERROR",
+			NumberFails: 5,
+			Throttle:    config,
+		},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	return f
+}
+
+func TestThrottleLadder(t *testing.T) {
+	var calls int32
+	f := newThrottleTestServer(t, ThrottleConfig{
+		DelayAfter:  1,
+		Delay:       "20ms",
+		RejectAfter: 3,
+		RetryAfter:  "30s",
+	}, &calls)
+
+	expected := []struct {
+		code     int
+		minDelay time.Duration
+	}{
+		{http.StatusNotFound, 0},
+		{http.StatusNotFound, 20 * time.Millisecond},
+		{http.StatusNotFound, 40 * time.Millisecond},
+		{http.StatusTooManyRequests, 0},
+		{http.StatusTooManyRequests, 0},
+		{http.StatusForbidden, 0},
+	}
+	for idx, e := range expected {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://garbage", nil)
+		request.RemoteAddr = "1.2.3.4:5678"
+		start := time.Now()
+		f.ServeHTTP(response, request)
+		if response.Code != e.code {
+			t.Errorf("Expected response %d to be %d but got %d", idx, e.code, response.Code)
+		}
+		if took := time.Since(start); took < e.minDelay {
+			t.Errorf("Expected response %d to be delayed by %s but took %s", idx, e.minDelay, took)
+		}
+		if e.code == http.StatusTooManyRequests && response.Header().Get("Retry-After") != "30" {
+			t.Errorf("Expected Retry-After 30, got %q", response.Header().Get("Retry-After"))
+		}
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("Only 3 requests should reach downstream, got %d", calls)
+	}
+
+	stats := f.snapshotStats()
+	if stats.Events[eventDelay] != 2 || stats.Events[eventReject] != 2 || stats.Events[eventBan] != 1 {
+		t.Errorf("Unexpected events %v", stats.Events)
+	}
+}
+
+func TestThrottleDelayCancelled(t *testing.T) {
+	var calls int32
+	f := newThrottleTestServer(t, ThrottleConfig{
+		DelayAfter: 1,
+		Delay:      "1h",
+		MaxDelay:   "1h",
+	}, &calls)
+	memory(f).clients["1.2.3.4"] = &client{lastViewed: time.Now(), failCounter: 1}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://garbage", nil).WithContext(ctx)
+	request.RemoteAddr = "1.2.3.4:5678"
+
+	done := make(chan struct{})
+	go func() {
+		f.ServeHTTP(response, request)
+		close(done)
+	}()
+
+	// the lock must not be held while delaying
+	time.Sleep(5 * time.Millisecond)
+	if !memory(f).mu.TryLock() {
+		t.Error("Lock should not be held while delaying")
+	} else {
+		memory(f).mu.Unlock()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Delay should stop when the request is cancelled")
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("Cancelled request should not reach downstream")
+	}
+}
+
+func TestThrottleStep(t *testing.T) {
+	th := &throttle{
+		delayAfter:  2,
+		delay:       time.Second,
+		maxDelay:    3 * time.Second,
+		rejectAfter: 6,
+	}
+	tests := map[uint]struct {
+		delay  time.Duration
+		reject bool
+	}{
+		0: {0, false},
+		1: {0, false},
+		2: {time.Second, false},
+		3: {2 * time.Second, false},
+		5: {3 * time.Second, false},
+		6: {0, true},
+		9: {0, true},
+	}
+	for fails, test := range tests {
+		delay, reject := th.step(fails)
+		if delay != test.delay || reject != test.reject {
+			t.Errorf("For %d failures expected %s %t, got %s %t", fails, test.delay, test.reject, delay, reject)
+		}
+	}
+}
+
+func TestThrottleConfig(t *testing.T) {
+	tests := map[string]struct {
+		config   ThrottleConfig
+		disabled bool
+		isError  bool
+	}{
+		"disabled":            {ThrottleConfig{}, true, false},
+		"delay only":          {ThrottleConfig{DelayAfter: 1}, false, false},
+		"reject only":         {ThrottleConfig{RejectAfter: 2}, false, false},
+		"delay after reject":  {ThrottleConfig{DelayAfter: 2, RejectAfter: 2}, false, true},
+		"reject after ban":    {ThrottleConfig{RejectAfter: 5}, false, true},
+		"invalid delay":       {ThrottleConfig{DelayAfter: 1, Delay: "garbage"}, false, true},
+		"invalid max delay":   {ThrottleConfig{DelayAfter: 1, MaxDelay: "garbage"}, false, true},
+		"invalid retry after": {ThrottleConfig{RejectAfter: 1, RetryAfter: "garbage"}, false, true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			th, err := newThrottle(test.config, 5)
+			if (err != nil) != test.isError {
+				t.Errorf("Unexpected error %v", err)
+			}
+			if !test.isError && (th == nil) != test.disabled {
+				t.Errorf("Expected disabled to be %t", test.disabled)
+			}
+		})
+	}
+}